@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/audit"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect the audit log",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify [file]",
+	Short: "Verify the hash chain and checkpoint signatures of the audit log",
+	Long: `Verify the hash chain and checkpoint signatures of the audit log, given as argument or by
+audit.file in the configuration. The command exits with a non-zero status at the first record that
+was modified, removed or inserted.
+
+Checkpoint certificates must be issued by one of the CA certificates given by --ca, or else by the
+CA of the default organization in the configuration, whose chain is fetched from the CA. Otherwise
+whoever rewrote the log could sign it with a key of their own. --insecure-skip-ca accepts any
+checkpoint certificate, which only proves that the log is consistent.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		caFile, _ := cmd.Flags().GetString("ca")
+		skipCA, _ := cmd.Flags().GetBool("insecure-skip-ca")
+
+		var cfg *config.Config
+		if len(args) == 0 || (caFile == "" && !skipCA) {
+			var err error
+			if cfg, _, err = config.LoadConfig(cmd); err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+		}
+
+		var file string
+		if len(args) > 0 {
+			file = args[0]
+		} else {
+			file = cfg.Audit.File
+		}
+		if file == "" {
+			return fmt.Errorf("no audit log given and audit.file is not configured")
+		}
+
+		var roots *x509.CertPool
+		switch {
+		case caFile != "":
+			b, err := os.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("failed to read CA certificates: %w", err)
+			}
+			roots = x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(b) {
+				return fmt.Errorf("no certificates found in %s", caFile)
+			}
+		case skipCA:
+			fmt.Fprintln(os.Stderr, "warning: checkpoint certificates are not verified against a CA")
+		default:
+			var err error
+			if roots, err = orgCARoots(cfg); err != nil {
+				return fmt.Errorf("%w; pass the CA certificates with --ca", err)
+			}
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer f.Close()
+
+		summary, err := audit.Verify(f, roots)
+		if err != nil {
+			return fmt.Errorf("audit log %s is invalid after %d records: %w", file, summary.Records, err)
+		}
+
+		fmt.Printf("%s: %d records, %d checkpoints, %d events not yet signed\n",
+			file, summary.Records, summary.Checkpoints, summary.Unsigned)
+		if len(summary.Signers) > 0 {
+			fmt.Printf("signed by: %s\n", strings.Join(summary.Signers, "; "))
+		}
+		return nil
+	},
+}
+
+// orgCARoots returns the CA chain of the default organization, whose admin signs checkpoints.
+func orgCARoots(cfg *config.Config) (*x509.CertPool, error) {
+	caClient, err := fabric.NewCAClient(cfg.Fabric.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := caClient.CAInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the CA chain of the default organization: %w", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(info.CAChain) {
+		return nil, fmt.Errorf("no certificates found in the CA chain of the default organization")
+	}
+	return roots, nil
+}
+
+func init() {
+	auditVerifyCmd.Flags().String("ca", "", "PEM file of CA certificates that must have issued the checkpoint certificates, defaults to the CA of the default organization")
+	auditVerifyCmd.Flags().Bool("insecure-skip-ca", false, "Accept checkpoint certificates of any issuer")
+	auditVerifyCmd.MarkFlagsMutuallyExclusive("ca", "insecure-skip-ca")
+
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/doctor"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Validate the configuration and check connectivity to the OIDC issuers and the Fabric network",
+	Long: `Validate the configuration and check connectivity to the OIDC issuers and the Fabric network.
+Every check is reported as PASS, WARN, FAIL or SKIP. The command exits with a non-zero status if any
+check failed, so it can run as an init container before the proxy starts.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, logger, err := config.LoadConfig(cmd)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+
+		channels, _ := cmd.Flags().GetStringSlice("channel")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+
+		report := doctor.Run(context.Background(), cfg, logger, doctor.Options{
+			Channels: channels,
+			Timeout:  timeout,
+		})
+		report.Print(os.Stdout)
+
+		if report.Failed() {
+			return fmt.Errorf("some checks failed")
+		}
+		return nil
+	},
+}
+
+func init() {
+	doctorCmd.Flags().StringSlice("channel", nil, "Channel the admin identities must be able to query (repeatable)")
+	doctorCmd.Flags().Duration("timeout", 10*time.Second, "Timeout of each network check")
+
+	rootCmd.AddCommand(doctorCmd)
+}
@@ -16,7 +16,7 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	// Persistent / Global flags
-	rootCmd.PersistentFlags().String("config", "", "Config file (default is ./config.yaml)")
+	rootCmd.PersistentFlags().String("config", "", "Config file in YAML, JSON or TOML format (default is ./config.{yaml,json,toml})")
 	rootCmd.PersistentFlags().String("loglevel", "info", "Log level (debug, info, warn, error, dpanic, panic, fatal)")
 
 	// bind persistent flags
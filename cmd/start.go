@@ -1,13 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
 	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
 	"github.com/edgeflare/fabric-oidc-proxy/internal/proxy"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/tracing"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"go.uber.org/zap"
 )
 
 var startCmd = &cobra.Command{
@@ -20,20 +23,36 @@ var startCmd = &cobra.Command{
 		}
 
 		logger.Info("Configuration loaded successfully")
+		holder := config.NewHolder(cfg, logger)
 
-		// initialize fabric CA client and enroll admin
-		fabric.Init(cfg, logger)
-		adminCAClient, err := fabric.NewCAClient(cfg)
+		shutdownTracing, err := tracing.Init(context.Background(), cfg.Tracing)
 		if err != nil {
-			return fmt.Errorf("failed to create CA client: %w", err)
+			return fmt.Errorf("failed to set up tracing: %w", err)
 		}
+		defer func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				logger.Error("Failed to flush traces", zap.Error(err))
+			}
+		}()
 
-		_, err = adminCAClient.EnrollAdmin()
-		if err != nil {
-			return fmt.Errorf("failed to enroll admin: %w", err)
+		// initialize fabric clients and enroll the admin of every organization
+		if err := fabric.Init(holder, logger); err != nil {
+			return fmt.Errorf("failed to initialize fabric client: %w", err)
+		}
+		for _, org := range fabric.Orgs() {
+			if err := org.EnrollAdmin(); err != nil {
+				return err
+			}
+		}
+
+		// reload the configuration on SIGHUP and when the config file changes
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if err := holder.Watch(ctx); err != nil {
+			return err
 		}
 
-		err = proxy.StartServer(cfg, logger) // Pass the logger here
+		err = proxy.StartServer(holder, logger) // Pass the logger here
 		if err != nil {
 			return fmt.Errorf("server error: %w", err)
 		}
@@ -0,0 +1,291 @@
+// Package audit records who did what through the proxy in a tamper-evident log. Records are JSON
+// lines, each holding the hash of the previous record, and the chain is periodically signed by the
+// proxy's own Fabric identity in checkpoint records.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record types.
+const (
+	TypeEvent      = "event"
+	TypeCheckpoint = "checkpoint"
+)
+
+// Actions recorded as events.
+const (
+	ActionEnroll = "enroll"
+	ActionSubmit = "submit"
+)
+
+// Results of actions.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultDenied  = "denied"
+)
+
+// genesisHash is the previous hash of the first record
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// Record is a line of the audit log.
+type Record struct {
+	Seq          uint64    `json:"seq"`
+	Time         time.Time `json:"time"`
+	Type         string    `json:"type"`
+	Action       string    `json:"action,omitempty"`
+	Issuer       string    `json:"iss,omitempty"`
+	Subject      string    `json:"sub,omitempty"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Org          string    `json:"org,omitempty"`
+	EnrollmentID string    `json:"enrollment_id,omitempty"`
+	Channel      string    `json:"channel,omitempty"`
+	Chaincode    string    `json:"chaincode,omitempty"`
+	Function     string    `json:"function,omitempty"`
+	ArgHashes    []string  `json:"arg_hashes,omitempty"` // hex SHA-256 of each argument, so that no payload is kept
+	TxID         string    `json:"tx_id,omitempty"`
+	Result       string    `json:"result,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	// Certificate is the PEM certificate of the identity signing a checkpoint
+	Certificate string `json:"certificate,omitempty"`
+	// Signature is the base64 signature of Hash by the key of Certificate
+	Signature string `json:"signature,omitempty"`
+	PrevHash  string `json:"prev_hash"`
+	Hash      string `json:"hash"`
+}
+
+// digest returns the SHA-256 of the record without its hash and signature.
+func (r Record) digest() ([]byte, error) {
+	r.Hash = ""
+	r.Signature = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// HashArgs returns the hex SHA-256 of every argument.
+func HashArgs(args []string) []string {
+	hashes := make([]string, 0, len(args))
+	for _, arg := range args {
+		sum := sha256.Sum256([]byte(arg))
+		hashes = append(hashes, hex.EncodeToString(sum[:]))
+	}
+	return hashes
+}
+
+// SignerFunc returns the PEM certificate and the signing function of the identity signing
+// checkpoints. It is called for every checkpoint, so that renewed certificates are picked up.
+type SignerFunc func() (cert []byte, sign func(digest []byte) ([]byte, error), err error)
+
+// Log appends records to an audit log file.
+type Log struct {
+	mu        sync.Mutex
+	file      *os.File
+	seq       uint64
+	head      string // hash of the last record
+	unsigned  int    // events since the last checkpoint
+	signer    SignerFunc
+	closeOnce sync.Once
+}
+
+// Open opens the audit log file for appending, continuing the hash chain of its last record.
+func Open(path string, signer SignerFunc) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l := &Log{file: file, head: genesisHash, signer: signer}
+
+	line, err := lastLine(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if line != nil {
+		var last Record
+		if err := json.Unmarshal(line, &last); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to parse last record of audit log %s: %w", path, err)
+		}
+		l.seq, l.head = last.Seq, last.Hash
+		if last.Type != TypeCheckpoint {
+			l.unsigned = 1
+		}
+	}
+
+	return l, nil
+}
+
+// Write appends an event to the log, setting its sequence number, time and hashes.
+func (l *Log) Write(rec Record) error {
+	rec.Type = TypeEvent
+	return l.append(rec, nil)
+}
+
+// Checkpoint appends a checkpoint signed by the signer if events were written since the last one.
+func (l *Log) Checkpoint() error {
+	l.mu.Lock()
+	unsigned := l.unsigned
+	l.mu.Unlock()
+	if unsigned == 0 {
+		return nil
+	}
+
+	cert, sign, err := l.signer()
+	if err != nil {
+		return fmt.Errorf("failed to load audit signing identity: %w", err)
+	}
+
+	return l.append(Record{Type: TypeCheckpoint, Certificate: string(cert)}, sign)
+}
+
+func (l *Log) append(rec Record, sign func([]byte) ([]byte, error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rec.Seq = l.seq + 1
+	rec.Time = time.Now().UTC()
+	rec.PrevHash = l.head
+
+	digest, err := rec.digest()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hex.EncodeToString(digest)
+
+	if sign != nil {
+		signature, err := sign(digest)
+		if err != nil {
+			return fmt.Errorf("failed to sign audit checkpoint: %w", err)
+		}
+		rec.Signature = base64.StdEncoding.EncodeToString(signature)
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit record: %w", err)
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+
+	l.seq, l.head = rec.Seq, rec.Hash
+	if rec.Type == TypeCheckpoint {
+		l.unsigned = 0
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync audit log: %w", err)
+		}
+	} else {
+		l.unsigned++
+	}
+
+	return nil
+}
+
+// Run writes a checkpoint every interval and a final one when ctx is done. Errors are passed to onError.
+func (l *Log) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := l.Checkpoint(); err != nil {
+				onError(err)
+			}
+			return
+		case <-ticker.C:
+			if err := l.Checkpoint(); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		err = l.file.Close()
+	})
+	return err
+}
+
+// lastLine returns the last line of the file, or nil if it is empty. A file not ending with a
+// newline holds an incomplete record, e.g. after a crash, which must be inspected before appending.
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+
+	for window := int64(64 << 10); ; window *= 2 {
+		if window > size {
+			window = size
+		}
+		buf := make([]byte, window)
+		if _, err := file.ReadAt(buf, size-window); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+		if buf[len(buf)-1] != '\n' {
+			return nil, fmt.Errorf("audit log %s ends with an incomplete record, check it with audit verify", file.Name())
+		}
+
+		buf = buf[:len(buf)-1]
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return buf[i+1:], nil
+		}
+		if window == size {
+			return buf, nil
+		}
+	}
+}
+
+// current is the log written by the package-level Write
+var current atomic.Pointer[Log]
+
+// Use makes l the log written by the package-level Write; nil disables auditing.
+func Use(l *Log) {
+	current.Store(l)
+}
+
+// Write appends an event to the log set by Use, if any. The result of the event is failure if the
+// action failed with actionErr, otherwise success unless set already, e.g. to denied.
+func Write(rec Record, actionErr error) error {
+	l := current.Load()
+	if l == nil {
+		return nil
+	}
+
+	if actionErr != nil {
+		rec.Result = ResultFailure
+		rec.Error = actionErr.Error()
+	} else if rec.Result == "" {
+		rec.Result = ResultSuccess
+	}
+
+	return l.Write(rec)
+}
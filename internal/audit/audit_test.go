@@ -0,0 +1,314 @@
+package audit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA is a CA issuing the certificate of the identity signing checkpoints.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// signer returns a SignerFunc of a new identity issued by the CA.
+func (ca *testCA) signer(t *testing.T) SignerFunc {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return func() ([]byte, func([]byte) ([]byte, error), error) {
+		return certPEM, func(digest []byte) ([]byte, error) {
+			return ecdsa.SignASN1(rand.Reader, key, digest)
+		}, nil
+	}
+}
+
+// writeLog writes events to a new log, with a checkpoint after every checkpointEvery events,
+// and returns its lines.
+func writeLog(t *testing.T, signer SignerFunc, events, checkpointEvery int) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= events; i++ {
+		if err := l.Write(Record{Action: ActionSubmit, Subject: "alice", Result: ResultSuccess}); err != nil {
+			t.Fatal(err)
+		}
+		if i%checkpointEvery == 0 {
+			if err := l.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	return lines[:len(lines)-1]
+}
+
+// modify returns line with the record's field changed to value, keeping its hash.
+func modify(t *testing.T, line, field string, value interface{}) string {
+	t.Helper()
+	var rec map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &rec); err != nil {
+		t.Fatal(err)
+	}
+	rec[field] = value
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b) + "\n"
+}
+
+func TestVerify(t *testing.T) {
+	ca := newTestCA(t, "org1 CA")
+	lines := writeLog(t, ca.signer(t), 5, 2) // e e c e e c e
+
+	tests := []struct {
+		name    string
+		log     func() []string
+		roots   *x509.CertPool
+		wantErr string
+	}{
+		{
+			name:  "intact",
+			log:   func() []string { return lines },
+			roots: ca.pool(),
+		},
+		{
+			name:  "intact without trust anchor",
+			log:   func() []string { return lines },
+			roots: nil,
+		},
+		{
+			name: "tampered event",
+			log: func() []string {
+				l := append([]string{}, lines...)
+				l[1] = modify(t, l[1], "sub", "mallory")
+				return l
+			},
+			wantErr: "line 2: hash does not match",
+		},
+		{
+			name: "tampered event with recomputed hash",
+			log: func() []string {
+				l := append([]string{}, lines...)
+				var rec Record
+				json.Unmarshal([]byte(l[1]), &rec)
+				rec.Subject = "mallory"
+				digest, _ := rec.digest()
+				rec.Hash = hex.EncodeToString(digest)
+				b, _ := json.Marshal(rec)
+				l[1] = string(b) + "\n"
+				return l
+			},
+			wantErr: "line 3: previous hash does not match",
+		},
+		{
+			name: "removed event",
+			log: func() []string {
+				return append(append([]string{}, lines[:3]...), lines[4:]...)
+			},
+			wantErr: "line 4: sequence number 5 follows 3",
+		},
+		{
+			name: "truncated at the start",
+			log: func() []string {
+				return lines[1:]
+			},
+			wantErr: "line 1: sequence number 2 follows 0",
+		},
+		{
+			name: "truncated within a record",
+			log: func() []string {
+				l := append([]string{}, lines...)
+				last := l[len(l)-1]
+				l[len(l)-1] = last[:len(last)/2]
+				return l
+			},
+			wantErr: "incomplete record at end of log",
+		},
+		{
+			name: "forged checkpoint signature",
+			log: func() []string {
+				l := append([]string{}, lines...)
+				forged := writeLog(t, ca.signer(t), 2, 2)
+				var rec, other Record
+				json.Unmarshal([]byte(l[2]), &rec)
+				json.Unmarshal([]byte(forged[2]), &other)
+				rec.Signature = other.Signature
+				b, _ := json.Marshal(rec)
+				l[2] = string(b) + "\n"
+				return l
+			},
+			wantErr: "line 3: invalid checkpoint signature",
+		},
+		{
+			name:    "checkpoint of another CA",
+			log:     func() []string { return writeLog(t, newTestCA(t, "rogue CA").signer(t), 2, 2) },
+			roots:   ca.pool(),
+			wantErr: "line 3: checkpoint certificate CN=proxy is not trusted",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Verify(strings.NewReader(strings.Join(tt.log(), "")), tt.roots)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Verify: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("Verify succeeded, want error %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("Verify: %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySummary(t *testing.T) {
+	ca := newTestCA(t, "org1 CA")
+	lines := writeLog(t, ca.signer(t), 5, 2)
+
+	s, err := Verify(strings.NewReader(strings.Join(lines, "")), ca.pool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Records != 7 || s.Checkpoints != 2 || s.Unsigned != 1 {
+		t.Errorf("got %d records, %d checkpoints, %d unsigned, want 7, 2, 1", s.Records, s.Checkpoints, s.Unsigned)
+	}
+	if len(s.Signers) != 1 || s.Signers[0] != "CN=proxy" {
+		t.Errorf("got signers %v, want [CN=proxy]", s.Signers)
+	}
+}
+
+func TestOpenContinuesChain(t *testing.T) {
+	ca := newTestCA(t, "org1 CA")
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for i := 0; i < 2; i++ {
+		l, err := Open(path, ca.signer(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Write(Record{Action: ActionEnroll}); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s, err := Verify(f, ca.pool())
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if s.Records != 4 {
+		t.Errorf("got %d records, want 4", s.Records)
+	}
+}
+
+func TestOpenRefusesIncompleteRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(`{"seq":1,"type":"event"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, nil); err == nil {
+		t.Fatal("Open succeeded on a log ending with an incomplete record")
+	}
+}
+
+func TestCheckpointSkippedWithoutEvents(t *testing.T) {
+	ca := newTestCA(t, "org1 CA")
+	lines := writeLog(t, ca.signer(t), 2, 1) // e c e c
+	if len(lines) != 4 {
+		t.Fatalf("got %d records, want 4", len(lines))
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path, ca.signer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Size() != 0 {
+		t.Errorf("checkpoint written without events")
+	}
+}
@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+)
+
+// Summary describes a verified audit log.
+type Summary struct {
+	Records     int      // records including checkpoints
+	Checkpoints int      // signed checkpoints
+	Unsigned    int      // events after the last checkpoint, not covered by a signature yet
+	Signers     []string // subjects of the checkpoint certificates
+}
+
+// Verify checks the hash chain and the checkpoint signatures of an audit log. If roots is not nil,
+// checkpoint certificates must chain to one of them. The first broken record is reported by line.
+func Verify(r io.Reader, roots *x509.CertPool) (*Summary, error) {
+	s := &Summary{}
+	signers := make(map[string]bool)
+	prevHash := genesisHash
+	var prevSeq uint64
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(b)) > 0 {
+				return s, fmt.Errorf("line %d: incomplete record at end of log", line)
+			}
+			return s, nil
+		}
+		if err != nil {
+			return s, fmt.Errorf("failed to read audit log: %w", err)
+		}
+
+		var rec Record
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return s, fmt.Errorf("line %d: invalid record: %w", line, err)
+		}
+		if rec.Seq != prevSeq+1 {
+			return s, fmt.Errorf("line %d: sequence number %d follows %d", line, rec.Seq, prevSeq)
+		}
+		if rec.PrevHash != prevHash {
+			return s, fmt.Errorf("line %d: previous hash does not match record %d", line, prevSeq)
+		}
+
+		digest, err := rec.digest()
+		if err != nil {
+			return s, fmt.Errorf("line %d: %w", line, err)
+		}
+		if hex.EncodeToString(digest) != rec.Hash {
+			return s, fmt.Errorf("line %d: hash does not match the record's content", line)
+		}
+
+		switch rec.Type {
+		case TypeCheckpoint:
+			cert, err := verifyCheckpoint(rec, digest, roots)
+			if err != nil {
+				return s, fmt.Errorf("line %d: %w", line, err)
+			}
+			s.Checkpoints++
+			s.Unsigned = 0
+			if subject := cert.Subject.String(); !signers[subject] {
+				signers[subject] = true
+				s.Signers = append(s.Signers, subject)
+			}
+		case TypeEvent:
+			s.Unsigned++
+		default:
+			return s, fmt.Errorf("line %d: unknown record type %q", line, rec.Type)
+		}
+
+		s.Records++
+		prevSeq, prevHash = rec.Seq, rec.Hash
+	}
+}
+
+// verifyCheckpoint verifies the signature of a checkpoint and returns its certificate.
+func verifyCheckpoint(rec Record, digest []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(rec.Certificate))
+	if block == nil {
+		return nil, fmt.Errorf("checkpoint has no certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint certificate: %w", err)
+	}
+
+	if roots != nil {
+		if _, err := cert.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: rec.Time,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			return nil, fmt.Errorf("checkpoint certificate %s is not trusted: %w", cert.Subject, err)
+		}
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(rec.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint signature: %w", err)
+	}
+
+	var valid bool
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(pub, digest, signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, digest, signature)
+	default:
+		return nil, fmt.Errorf("unsupported checkpoint key type %T", pub)
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid checkpoint signature by %s", cert.Subject)
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
+	"github.com/edgeflare/pgo"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// ClientCerts authenticates users by the TLS client certificate they presented. The certificate
+// chain is verified by the TLS handshake against the configured CA bundle; ClientCerts only maps
+// the verified leaf certificate to a user.
+type ClientCerts struct {
+	conf config.ClientAuthConfig
+	pool *x509.CertPool
+}
+
+// NewClientCerts loads the CA bundle client certificates are verified against.
+func NewClientCerts(conf config.ClientAuthConfig) (*ClientCerts, error) {
+	switch conf.Subject {
+	case "", "cn", "dn", "email", "dns", "uri":
+	default:
+		return nil, fmt.Errorf("unknown http.tls.client_auth.subject %q", conf.Subject)
+	}
+
+	pem, err := os.ReadFile(conf.CA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", conf.CA)
+	}
+
+	return &ClientCerts{conf: conf, pool: pool}, nil
+}
+
+// ConfigureTLS makes the server request client certificates and verify them against the CA bundle.
+func (c *ClientCerts) ConfigureTLS(tlsConfig *tls.Config) {
+	tlsConfig.ClientCAs = c.pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.conf.Required {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+}
+
+// Authenticate returns the user of the request's verified client certificate, if any.
+func (c *ClientCerts) Authenticate(r *http.Request) (*oidc.IntrospectionResponse, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, fmt.Errorf("no verified client certificate")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	subject, err := c.subject(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]map[string]interface{}, 0, len(c.conf.Attributes))
+	for _, attr := range c.conf.Attributes {
+		attrs = append(attrs, map[string]interface{}{"name": attr.Name, "value": attr.Value, "ecert": attr.ECert})
+	}
+
+	idType := c.conf.Type
+	if idType == "" {
+		idType = "client"
+	}
+
+	user := &oidc.IntrospectionResponse{
+		Active:     true,
+		Issuer:     config.ClientCertIssuer,
+		Subject:    subject,
+		TokenType:  "client_certificate",
+		Expiration: oidc.FromTime(cert.NotAfter),
+		NotBefore:  oidc.FromTime(cert.NotBefore),
+		Claims: map[string]interface{}{
+			"dn": cert.Subject.String(),
+			"ou": cert.Subject.OrganizationalUnit,
+			// the registration request enrollment reads, as the fabric claim of OIDC users
+			"fabric": map[string]interface{}{
+				"type":            idType,
+				"affiliation":     c.conf.Affiliation,
+				"attrs":           attrs,
+				"max_enrollments": c.conf.MaxEnrollments,
+			},
+		},
+	}
+
+	return user, nil
+}
+
+// subject maps the certificate to the user's subject according to http.tls.client_auth.subject.
+// Distinguished names and URIs hold characters enrollment IDs must not contain, such as / and whitespace,
+// so they are base64url-encoded. Other subjects are validated like those of OIDC users, except that
+// they may contain @, since the namespace of client certificates is required and distinct.
+func (c *ClientCerts) subject(cert *x509.Certificate) (string, error) {
+	var subject string
+	switch c.conf.Subject {
+	case "", "cn":
+		subject = cert.Subject.CommonName
+	case "dn":
+		subject = encodeSubject(cert.Subject.String())
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			subject = cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			subject = cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			subject = encodeSubject(cert.URIs[0].String())
+		}
+	}
+
+	if subject == "" {
+		return "", fmt.Errorf("client certificate has no %s to map to a subject", c.conf.Subject)
+	}
+	if err := checkSubject(subject); err != nil {
+		return "", fmt.Errorf("client certificate %s: %w", c.conf.Subject, err)
+	}
+	return subject, nil
+}
+
+// encodeSubject encodes a subject with base64url, which only uses characters valid in enrollment IDs.
+func encodeSubject(s string) string {
+	if s == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// Middleware authenticates requests by their client certificate, storing the user under
+// pgo.OIDCUserCtxKey like the token middleware does. Requests with an Authorization header, or
+// without a client certificate, are passed to tokenAuth, unless client certificates are required.
+func (c *ClientCerts) Middleware(tokenAuth func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		withToken := tokenAuth(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !c.conf.Required && r.Header.Get("Authorization") != "" {
+				withToken.ServeHTTP(w, r)
+				return
+			}
+
+			user, err := c.Authenticate(r)
+			if err != nil {
+				if c.conf.Required {
+					problem.Error(w, r, "invalid client certificate: "+err.Error(), http.StatusUnauthorized)
+					return
+				}
+				withToken.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), pgo.OIDCUserCtxKey, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/util"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// ErrUntrustedIssuer is returned for tokens whose iss claim does not match any trusted issuer.
+var ErrUntrustedIssuer = errors.New("token issuer is not trusted")
+
+// TokenVerifier verifies a bearer token and returns the authenticated user.
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (*oidc.IntrospectionResponse, error)
+}
+
+// Verifiers verifies tokens of several trusted issuers, selecting the issuer by the iss claim.
+// Opaque tokens carry no iss claim; they are introspected at the first trusted issuer only,
+// so that tokens are never sent to a partner's IdP they were not issued by.
+type Verifiers struct {
+	byIssuer map[string]*Verifier
+	opaque   *Verifier
+}
+
+// NewVerifiers creates a Verifier for every trusted issuer in the OIDC configuration.
+func NewVerifiers(ctx context.Context, conf config.OIDCConfig) (*Verifiers, error) {
+	issuers := conf.TrustedIssuers()
+	if len(issuers) == 0 {
+		return nil, fmt.Errorf("no trusted OIDC issuer configured")
+	}
+
+	vs := &Verifiers{byIssuer: make(map[string]*Verifier, len(issuers))}
+	for _, issuer := range issuers {
+		if _, ok := vs.byIssuer[issuer.Issuer]; ok {
+			return nil, fmt.Errorf("issuer %s is configured more than once", issuer.Issuer)
+		}
+
+		v, err := NewVerifier(ctx, issuer, conf)
+		if err != nil {
+			return nil, err
+		}
+
+		vs.byIssuer[issuer.Issuer] = v
+		if vs.opaque == nil {
+			vs.opaque = v
+		}
+	}
+
+	return vs, nil
+}
+
+// Verify selects the trusted issuer from the unverified iss claim and verifies the token with it.
+func (vs *Verifiers) Verify(ctx context.Context, token string) (*oidc.IntrospectionResponse, error) {
+	if !isJWT(token) {
+		return vs.opaque.Verify(ctx, token)
+	}
+
+	var claims oidc.TokenClaims
+	if _, err := oidc.ParseToken(token, &claims); err != nil {
+		return nil, err
+	}
+
+	v, ok := vs.byIssuer[claims.Issuer]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUntrustedIssuer, claims.Issuer)
+	}
+
+	return v.Verify(ctx, token)
+}
+
+// mapClaims applies the issuer's claim mapping to the verified user and validates the resulting
+// subject, which becomes part of the user's enrollment ID.
+func mapClaims(user *oidc.IntrospectionResponse, mapping config.ClaimMapping) error {
+	if mapping.Subject != "" {
+		claims, err := AllClaims(user)
+		if err != nil {
+			return err
+		}
+
+		subject, err := util.Jq(claims, mapping.Subject)
+		if err != nil {
+			return fmt.Errorf("failed to read subject claim %s: %w", mapping.Subject, err)
+		}
+
+		s, ok := subject.(string)
+		if !ok {
+			return fmt.Errorf("subject claim %s is missing or not a string", mapping.Subject)
+		}
+		user.Subject = s
+	}
+
+	if err := checkSubject(user.Subject); err != nil {
+		return err
+	}
+	// @ separates the subject from the issuer's namespace in enrollment IDs
+	if strings.Contains(user.Subject, "@") {
+		return fmt.Errorf("invalid subject %q: must not contain @", user.Subject)
+	}
+	return nil
+}
+
+// checkSubject rejects subjects that cannot be used as enrollment ID, which is a path segment of
+// both the CA's REST API and the user's directory below fabric.ca.client_home.
+func checkSubject(subject string) error {
+	if subject == "" || subject == "." {
+		return fmt.Errorf("invalid subject %q", subject)
+	}
+	if strings.Contains(subject, "..") || strings.ContainsAny(subject, "/\\?#%") {
+		return fmt.Errorf("invalid subject %q: must not contain .., /, \\, ?, # or %%", subject)
+	}
+	for _, r := range subject {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("invalid subject %q: must not contain whitespace or control characters", subject)
+		}
+	}
+	return nil
+}
+
+// AllClaims returns the standard and custom claims of the user as a single map, suitable for util.Jq.
+func AllClaims(user *oidc.IntrospectionResponse) (map[string]interface{}, error) {
+	b, err := json.Marshal(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal claims: %w", err)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal claims: %w", err)
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	httphelper "github.com/zitadel/oidc/v3/pkg/http"
+)
+
+// jwksStatus tracks the last successful fetch of an issuer's JWKS.
+type jwksStatus struct {
+	mu        sync.Mutex
+	fetchedAt time.Time
+}
+
+// JWKSResult is the freshness of an issuer's JWKS.
+type JWKSResult struct {
+	FetchedAt time.Time // last successful fetch
+	Err       error
+}
+
+// CheckJWKS reports whether the JWKS of every issuer verifying JWTs locally was fetched within
+// maxAge, by issuer. Key sets older than half of maxAge are fetched again, so that a key set only
+// turns stale once the issuer was unreachable for a while.
+func (vs *Verifiers) CheckJWKS(ctx context.Context, maxAge time.Duration) map[string]JWKSResult {
+	results := make(map[string]JWKSResult, len(vs.byIssuer))
+	for issuer, v := range vs.byIssuer {
+		if v.introspectOnly || v.jwksURI == "" {
+			continue
+		}
+		fetchedAt, err := v.checkJWKS(ctx, maxAge)
+		results[issuer] = JWKSResult{FetchedAt: fetchedAt, Err: err}
+	}
+	return results
+}
+
+func (v *Verifier) checkJWKS(ctx context.Context, maxAge time.Duration) (time.Time, error) {
+	v.jwks.mu.Lock()
+	defer v.jwks.mu.Unlock()
+
+	if time.Since(v.jwks.fetchedAt) <= maxAge/2 {
+		return v.jwks.fetchedAt, nil
+	}
+
+	err := fetchJWKS(ctx, v.jwksURI)
+	if err == nil {
+		v.jwks.fetchedAt = time.Now()
+		return v.jwks.fetchedAt, nil
+	}
+
+	if !v.jwks.fetchedAt.IsZero() && time.Since(v.jwks.fetchedAt) <= maxAge {
+		return v.jwks.fetchedAt, nil
+	}
+
+	return v.jwks.fetchedAt, fmt.Errorf("JWKS of issuer %s is stale: %w", v.issuer, err)
+}
+
+// fetchJWKS fetches a JWKS and checks that it holds at least one key.
+func fetchJWKS(ctx context.Context, uri string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create JWKS request: %w", err)
+	}
+
+	resp, err := httphelper.DefaultHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+	if len(jwks.Keys) == 0 {
+		return fmt.Errorf("JWKS holds no keys")
+	}
+
+	return nil
+}
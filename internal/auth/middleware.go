@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
+	"github.com/edgeflare/pgo"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// VerifyToken returns a middleware that authenticates requests using the bearer token in the
+// Authorization header. The verified claims are stored under pgo.OIDCUserCtxKey, exactly like
+// the introspection based middleware of pgo, so pgo.OIDCUser keeps working in handlers.
+func VerifyToken(v TokenVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				problem.Error(w, r, "missing bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			user, err := v.Verify(r.Context(), token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				problem.Error(w, r, "invalid token: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), pgo.OIDCUserCtxKey, user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(oidc.PrefixBearer) || !strings.EqualFold(header[:len(oidc.PrefixBearer)], oidc.PrefixBearer) {
+		return "", false
+	}
+
+	token := strings.TrimSpace(header[len(oidc.PrefixBearer):])
+	return token, token != ""
+}
@@ -0,0 +1,341 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
+	"github.com/zitadel/oidc/v3/pkg/client/rp"
+	httphelper "github.com/zitadel/oidc/v3/pkg/http"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+const (
+	sessionCookie = "fabric_proxy_session"
+	// CSRFCookie is readable by scripts, which must echo its value in the CSRFHeader of unsafe requests.
+	CSRFCookie = "fabric_proxy_csrf"
+	CSRFHeader = "X-CSRF-Token"
+
+	// refreshLeeway is how long before expiry the access token of a session is refreshed
+	refreshLeeway = 30 * time.Second
+
+	// sessionChunkSize is how much of a session is stored per cookie, so that each encrypted and
+	// encoded cookie stays below the 4096 bytes securecookie and browsers accept
+	sessionChunkSize = 2000
+	// maxSessionChunks is the number of cookies a session may take at most
+	maxSessionChunks = 8
+)
+
+// session is the state kept in the encrypted session cookie.
+type session struct {
+	AccessToken  string    `json:"at"`
+	RefreshToken string    `json:"rt,omitempty"`
+	Expiry       time.Time `json:"exp"`
+	CSRF         string    `json:"csrf"`
+}
+
+// Sessions implements browser login with the authorization code flow with PKCE. The tokens are
+// kept in encrypted cookies, and the access token is refreshed transparently before it expires.
+// Since tokens of many IdPs exceed what a single cookie holds, a session is split across cookies
+// named fabric_proxy_session, fabric_proxy_session_1 and so on.
+type Sessions struct {
+	conf         config.SessionConfig
+	relyingParty rp.RelyingParty
+	cookies      *httphelper.CookieHandler
+}
+
+// NewSessions creates the relying party for the issuer configured by the top-level oidc.* keys.
+func NewSessions(ctx context.Context, conf config.OIDCConfig) (*Sessions, error) {
+	if len(conf.Session.Secret) < 32 {
+		return nil, fmt.Errorf("oidc.session.secret must be at least 32 characters long")
+	}
+
+	opts := []httphelper.CookieHandlerOpt{}
+	if conf.Session.Insecure {
+		opts = append(opts, httphelper.WithUnsecure())
+	}
+	cookies := httphelper.NewCookieHandler(
+		deriveKey(conf.Session.Secret, "hash"),
+		deriveKey(conf.Session.Secret, "encrypt"),
+		opts...,
+	)
+
+	relyingParty, err := rp.NewRelyingPartyOIDC(ctx, conf.Issuer, conf.ClientID, conf.ClientSecret,
+		conf.Session.RedirectURI, conf.Session.Scopes,
+		rp.WithPKCE(cookies),
+		rp.WithCookieHandler(cookies),
+		rp.WithSigningAlgsFromDiscovery(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OIDC relying party: %w", err)
+	}
+
+	return &Sessions{conf: conf.Session, relyingParty: relyingParty, cookies: cookies}, nil
+}
+
+// LoginHandler redirects the browser to the issuer's authorization endpoint.
+func (s *Sessions) LoginHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, err := randomToken()
+		if err != nil {
+			problem.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rp.AuthURLHandler(func() string { return state }, s.relyingParty).ServeHTTP(w, r)
+	})
+}
+
+// CallbackHandler exchanges the authorization code for tokens and establishes the session.
+func (s *Sessions) CallbackHandler() http.Handler {
+	callback := func(w http.ResponseWriter, r *http.Request, tokens *oidc.Tokens[*oidc.IDTokenClaims], state string, _ rp.RelyingParty) {
+		csrf, err := randomToken()
+		if err != nil {
+			problem.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sess := session{
+			AccessToken:  tokens.AccessToken,
+			RefreshToken: tokens.RefreshToken,
+			Expiry:       tokens.Expiry,
+			CSRF:         csrf,
+		}
+
+		if err := s.store(w, r, sess); err != nil {
+			problem.Error(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, s.conf.PostLoginRedirect, http.StatusFound)
+	}
+
+	return rp.CodeExchangeHandler(callback, s.relyingParty)
+}
+
+// LogoutHandler ends the session, revokes its refresh token and, if supported, ends the session at
+// the issuer. It must be served for POST only, and requires the session's CSRF token in the
+// X-CSRF-Token header or the csrf_token form field, so that other sites cannot log users out.
+func (s *Sessions) LogoutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sess, err := s.load(r); err == nil {
+			token := r.Header.Get(CSRFHeader)
+			if token == "" {
+				token = r.PostFormValue("csrf_token")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(sess.CSRF)) != 1 {
+				problem.Error(w, r, "missing or invalid CSRF token", http.StatusForbidden)
+				return
+			}
+
+			if sess.RefreshToken != "" {
+				// best effort, the session cookies are deleted regardless
+				_ = rp.RevokeToken(r.Context(), s.relyingParty, sess.RefreshToken, "refresh_token")
+			}
+		}
+
+		s.delete(w, r)
+
+		redirect := s.conf.PostLogoutRedirect
+		if endSession, err := rp.EndSession(r.Context(), s.relyingParty, "", s.conf.PostLogoutRedirect, ""); err == nil && endSession != nil {
+			redirect = endSession.String()
+		}
+		if redirect == "" {
+			redirect = "/"
+		}
+
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	})
+}
+
+// Middleware authenticates requests without an Authorization header by their session cookie.
+// Unsafe methods must carry the session's CSRF token in the X-CSRF-Token header. The session's
+// access token is passed on as bearer token, so the token verification middleware that follows
+// handles cookie and bearer authentication alike.
+func (s *Sessions) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sess, err := s.load(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !safeMethod(r.Method) && subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRFHeader)), []byte(sess.CSRF)) != 1 {
+			problem.Error(w, r, "missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		if time.Until(sess.Expiry) < refreshLeeway {
+			if err := s.refresh(w, r, &sess); err != nil {
+				s.delete(w, r)
+				problem.Error(w, r, "session expired", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", oidc.PrefixBearer+sess.AccessToken)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refresh renews the session's tokens and stores the updated session.
+func (s *Sessions) refresh(w http.ResponseWriter, r *http.Request, sess *session) error {
+	if sess.RefreshToken == "" {
+		return fmt.Errorf("session has no refresh token")
+	}
+
+	tokens, err := rp.RefreshTokens[*oidc.IDTokenClaims](r.Context(), s.relyingParty, sess.RefreshToken, "", "")
+	if err != nil {
+		return err
+	}
+
+	sess.AccessToken = tokens.AccessToken
+	sess.Expiry = tokens.Expiry
+	if tokens.RefreshToken != "" {
+		sess.RefreshToken = tokens.RefreshToken
+	}
+
+	return s.store(w, r, *sess)
+}
+
+// load reads the session from its cookies. Every cookie holds the session's generation and number
+// of cookies along with its part, so that parts of different sessions are never combined.
+func (s *Sessions) load(r *http.Request) (session, error) {
+	var sess session
+
+	value, err := s.cookies.CheckCookie(r, sessionCookieName(0))
+	if err != nil {
+		return sess, err
+	}
+	generation, count, part, err := parseSessionChunk(value)
+	if err != nil {
+		return sess, err
+	}
+
+	var b strings.Builder
+	b.WriteString(part)
+	for i := 1; i < count; i++ {
+		value, err := s.cookies.CheckCookie(r, sessionCookieName(i))
+		if err != nil {
+			return sess, fmt.Errorf("incomplete session: %w", err)
+		}
+		g, c, part, err := parseSessionChunk(value)
+		if err != nil {
+			return sess, err
+		}
+		if g != generation || c != count {
+			return sess, fmt.Errorf("incomplete session: cookie %d belongs to another session", i)
+		}
+		b.WriteString(part)
+	}
+
+	err = json.Unmarshal([]byte(b.String()), &sess)
+	return sess, err
+}
+
+// store writes the session to as many cookies as it needs, deleting those of a previous, larger one.
+func (s *Sessions) store(w http.ResponseWriter, r *http.Request, sess session) error {
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	count := (len(b) + sessionChunkSize - 1) / sessionChunkSize
+	if count > maxSessionChunks {
+		return fmt.Errorf("session of %d bytes exceeds %d cookies", len(b), maxSessionChunks)
+	}
+
+	generation, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < count; i++ {
+		part := b[i*sessionChunkSize : min(len(b), (i+1)*sessionChunkSize)]
+		value := fmt.Sprintf("%s %d %s", generation, count, part)
+		if err := s.cookies.SetCookie(w, sessionCookieName(i), value); err != nil {
+			return fmt.Errorf("failed to set session cookie: %w", err)
+		}
+	}
+	s.deleteFrom(w, r, count)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    sess.CSRF,
+		Path:     "/",
+		Secure:   !s.conf.Insecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return nil
+}
+
+// delete deletes the session cookies and the CSRF cookie.
+func (s *Sessions) delete(w http.ResponseWriter, r *http.Request) {
+	s.deleteFrom(w, r, 0)
+	http.SetCookie(w, &http.Cookie{Name: CSRFCookie, Path: "/", MaxAge: -1})
+}
+
+// deleteFrom deletes the session cookies the request carries, starting with the i-th.
+func (s *Sessions) deleteFrom(w http.ResponseWriter, r *http.Request, i int) {
+	for ; i < maxSessionChunks; i++ {
+		if _, err := r.Cookie(sessionCookieName(i)); err == nil {
+			s.cookies.DeleteCookie(w, sessionCookieName(i))
+		}
+	}
+}
+
+func sessionCookieName(i int) string {
+	if i == 0 {
+		return sessionCookie
+	}
+	return sessionCookie + "_" + strconv.Itoa(i)
+}
+
+// parseSessionChunk splits the value of a session cookie into generation, number of cookies and part.
+func parseSessionChunk(value string) (string, int, string, error) {
+	fields := strings.SplitN(value, " ", 3)
+	if len(fields) != 3 {
+		return "", 0, "", fmt.Errorf("malformed session cookie")
+	}
+	count, err := strconv.Atoi(fields[1])
+	if err != nil || count < 1 || count > maxSessionChunks {
+		return "", 0, "", fmt.Errorf("malformed session cookie")
+	}
+	return fields[0], count, fields[2], nil
+}
+
+// deriveKey derives a 32 byte key for purpose from the session secret.
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("fabric-oidc-proxy session " + purpose))
+	return mac.Sum(nil)
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	httphelper "github.com/zitadel/oidc/v3/pkg/http"
+)
+
+func testSessions() *Sessions {
+	secret := strings.Repeat("s", 32)
+	return &Sessions{
+		conf:    config.SessionConfig{Secret: secret},
+		cookies: httphelper.NewCookieHandler(deriveKey(secret, "hash"), deriveKey(secret, "encrypt")),
+	}
+}
+
+// token returns a random token of n characters, like a JWT of that size.
+func token(t *testing.T, n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)[:n]
+}
+
+// roundTrip stores sess in response to req and returns the request of the browser that follows.
+func roundTrip(t *testing.T, s *Sessions, req *http.Request, sess session) *http.Request {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := s.store(rec, req, sess); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	jar := make(map[string]*http.Cookie)
+	for _, c := range req.Cookies() {
+		jar[c.Name] = c
+	}
+	for _, c := range rec.Result().Cookies() {
+		if len(c.String()) > 4096 {
+			t.Errorf("cookie %s is %d bytes long", c.Name, len(c.String()))
+		}
+		if c.MaxAge < 0 {
+			delete(jar, c.Name)
+		} else {
+			jar[c.Name] = c
+		}
+	}
+
+	next := httptest.NewRequest(http.MethodGet, "/api/v1", nil)
+	for _, c := range jar {
+		next.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return next
+}
+
+func TestSessionCookies(t *testing.T) {
+	tests := []struct {
+		name         string
+		accessToken  int
+		refreshToken int
+		cookies      int
+	}{
+		{"small tokens", 800, 300, 1},
+		{"keycloak tokens", 1600, 900, 2},
+		{"access token with many roles", 6000, 900, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSessions()
+			sess := session{
+				AccessToken:  token(t, tt.accessToken),
+				RefreshToken: token(t, tt.refreshToken),
+				Expiry:       time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+				CSRF:         "csrf",
+			}
+
+			req := roundTrip(t, s, httptest.NewRequest(http.MethodGet, "/auth/callback", nil), sess)
+			var n int
+			for _, c := range req.Cookies() {
+				if strings.HasPrefix(c.Name, sessionCookie) {
+					n++
+				}
+			}
+			if n != tt.cookies {
+				t.Errorf("session takes %d cookies, want %d", n, tt.cookies)
+			}
+
+			loaded, err := s.load(req)
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if loaded.AccessToken != sess.AccessToken || loaded.RefreshToken != sess.RefreshToken ||
+				!loaded.Expiry.Equal(sess.Expiry) || loaded.CSRF != sess.CSRF {
+				t.Errorf("loaded session differs from stored one")
+			}
+		})
+	}
+}
+
+func TestSessionShrinks(t *testing.T) {
+	s := testSessions()
+	large := session{AccessToken: token(t, 6000), CSRF: "csrf"}
+	small := session{AccessToken: token(t, 500), CSRF: "csrf"}
+
+	req := roundTrip(t, s, httptest.NewRequest(http.MethodGet, "/", nil), large)
+	req = roundTrip(t, s, req, small)
+
+	for _, c := range req.Cookies() {
+		if c.Name != sessionCookie && strings.HasPrefix(c.Name, sessionCookie) {
+			t.Errorf("cookie %s of the larger session was not deleted", c.Name)
+		}
+	}
+	loaded, err := s.load(req)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if loaded.AccessToken != small.AccessToken {
+		t.Errorf("loaded the larger session")
+	}
+}
+
+func TestSessionRejectsMixedCookies(t *testing.T) {
+	s := testSessions()
+	a := roundTrip(t, s, httptest.NewRequest(http.MethodGet, "/", nil), session{AccessToken: token(t, 3000)})
+	b := roundTrip(t, s, httptest.NewRequest(http.MethodGet, "/", nil), session{AccessToken: token(t, 3000)})
+
+	mixed := httptest.NewRequest(http.MethodGet, "/", nil)
+	first, _ := a.Cookie(sessionCookieName(0))
+	second, _ := b.Cookie(sessionCookieName(1))
+	mixed.AddCookie(first)
+	mixed.AddCookie(second)
+
+	if _, err := s.load(mixed); err == nil {
+		t.Errorf("loaded a session combined from cookies of two sessions")
+	}
+}
+
+func TestLogoutRequiresCSRFToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"without token", "", http.StatusForbidden},
+		{"with wrong token", "other", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testSessions()
+			req := roundTrip(t, s, httptest.NewRequest(http.MethodGet, "/", nil), session{AccessToken: "at", CSRF: "csrf"})
+			logout := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+			for _, c := range req.Cookies() {
+				logout.AddCookie(c)
+			}
+			if tt.header != "" {
+				logout.Header.Set(CSRFHeader, tt.header)
+			}
+
+			rec := httptest.NewRecorder()
+			s.LogoutHandler().ServeHTTP(rec, logout)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+			for _, c := range rec.Result().Cookies() {
+				if c.MaxAge < 0 {
+					t.Errorf("cookie %s was deleted", c.Name)
+				}
+			}
+		})
+	}
+}
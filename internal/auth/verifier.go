@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/zitadel/oidc/v3/pkg/client"
+	"github.com/zitadel/oidc/v3/pkg/client/rp"
+	"github.com/zitadel/oidc/v3/pkg/client/rs"
+	httphelper "github.com/zitadel/oidc/v3/pkg/http"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+var (
+	// ErrTokenNotYetValid is returned when the nbf claim of a token lies in the future.
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	// ErrTokenInactive is returned when introspection reports an opaque token as inactive.
+	ErrTokenInactive = errors.New("token is not active")
+	// ErrIntrospectionUnavailable is returned for opaque tokens when no client secret is configured.
+	ErrIntrospectionUnavailable = errors.New("opaque tokens require introspection, but no client secret is configured")
+)
+
+// Verifier validates bearer tokens issued by an OIDC provider.
+// JWT access tokens are validated locally against the issuer's JWKS, which is fetched from the
+// discovery document and cached. Opaque tokens fall back to token introspection.
+type Verifier struct {
+	issuer         string
+	audience       string
+	signingAlgs    []string
+	clockSkew      time.Duration
+	introspectOnly bool
+	claims         config.ClaimMapping
+	keySet         oidc.KeySet
+	jwksURI        string
+	jwks           jwksStatus
+	resourceServer rs.ResourceServer
+}
+
+// NewVerifier discovers the endpoints of a trusted issuer and returns a Verifier for it.
+// The verification mode and clock skew are taken from the global OIDC configuration.
+func NewVerifier(ctx context.Context, issuer config.IssuerConfig, conf config.OIDCConfig) (*Verifier, error) {
+	discovery, err := client.Discover(ctx, issuer.Issuer, httphelper.DefaultHTTPClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC issuer %s: %w", issuer.Issuer, err)
+	}
+
+	introspectOnly := conf.Verification == "introspect"
+	if !introspectOnly && discovery.JwksURI == "" {
+		return nil, fmt.Errorf("issuer %s does not publish a jwks_uri", issuer.Issuer)
+	}
+
+	v := &Verifier{
+		issuer:         issuer.Issuer,
+		audience:       issuer.Audience,
+		signingAlgs:    issuer.SigningAlgs,
+		clockSkew:      conf.ClockSkew,
+		introspectOnly: introspectOnly,
+		claims:         issuer.Claims,
+	}
+
+	if discovery.JwksURI != "" {
+		v.keySet = rp.NewRemoteKeySet(httphelper.DefaultHTTPClient, discovery.JwksURI)
+		v.jwksURI = discovery.JwksURI
+	}
+
+	if v.audience == "" {
+		v.audience = issuer.ClientID
+	}
+
+	if len(v.signingAlgs) == 0 {
+		v.signingAlgs = discovery.IDTokenSigningAlgValuesSupported
+	}
+
+	if issuer.ClientSecret != "" && discovery.IntrospectionEndpoint != "" {
+		v.resourceServer, err = rs.NewResourceServerClientCredentials(ctx, issuer.Issuer, issuer.ClientID, issuer.ClientSecret,
+			rs.WithStaticEndpoints(discovery.TokenEndpoint, discovery.IntrospectionEndpoint),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create introspection client: %w", err)
+		}
+	}
+
+	if introspectOnly && v.resourceServer == nil {
+		return nil, fmt.Errorf("issuer %s: introspection requires a client secret and an introspection endpoint", issuer.Issuer)
+	}
+
+	return v, nil
+}
+
+// Verify validates the token and returns its claims in the shape of an introspection response,
+// so that handlers can treat locally validated and introspected tokens alike.
+func (v *Verifier) Verify(ctx context.Context, token string) (*oidc.IntrospectionResponse, error) {
+	user, err := v.verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Issuer == "" {
+		user.Issuer = v.issuer
+	}
+
+	if err := mapClaims(user, v.claims); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Issuer returns the issuer URL the Verifier trusts.
+func (v *Verifier) Issuer() string {
+	return v.issuer
+}
+
+func (v *Verifier) verify(ctx context.Context, token string) (*oidc.IntrospectionResponse, error) {
+	if v.introspectOnly || !isJWT(token) {
+		return v.introspect(ctx, token)
+	}
+
+	claims := new(oidc.AccessTokenClaims)
+	payload, err := oidc.ParseToken(token, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := oidc.CheckIssuer(claims, v.issuer); err != nil {
+		return nil, err
+	}
+
+	if err := oidc.CheckAudience(claims, v.audience); err != nil {
+		return nil, err
+	}
+
+	if err := oidc.CheckSignature(ctx, token, payload, claims, v.signingAlgs, v.keySet); err != nil {
+		return nil, err
+	}
+
+	if err := oidc.CheckExpiration(claims, -v.clockSkew); err != nil {
+		return nil, err
+	}
+
+	if nbf := claims.NotBefore.AsTime(); !nbf.IsZero() && time.Now().Add(v.clockSkew).Before(nbf) {
+		return nil, ErrTokenNotYetValid
+	}
+
+	return introspectionFromClaims(claims), nil
+}
+
+// introspect calls the issuer's introspection endpoint for tokens that cannot be validated locally.
+func (v *Verifier) introspect(ctx context.Context, token string) (*oidc.IntrospectionResponse, error) {
+	if v.resourceServer == nil {
+		return nil, ErrIntrospectionUnavailable
+	}
+
+	resp, err := rs.Introspect[*oidc.IntrospectionResponse](ctx, v.resourceServer, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to introspect token: %w", err)
+	}
+
+	if !resp.Active {
+		return nil, ErrTokenInactive
+	}
+
+	return resp, nil
+}
+
+// introspectionFromClaims maps validated access token claims onto an introspection response.
+func introspectionFromClaims(claims *oidc.AccessTokenClaims) *oidc.IntrospectionResponse {
+	return &oidc.IntrospectionResponse{
+		Active:     true,
+		Scope:      claims.Scopes,
+		ClientID:   claims.ClientID,
+		TokenType:  oidc.BearerToken,
+		Expiration: claims.Expiration,
+		IssuedAt:   claims.IssuedAt,
+		AuthTime:   claims.AuthTime,
+		NotBefore:  claims.NotBefore,
+		Subject:    claims.Subject,
+		Audience:   claims.Audience,
+		Issuer:     claims.Issuer,
+		JWTID:      claims.JWTID,
+		Actor:      claims.Actor,
+		Claims:     claims.Claims,
+
+		AuthenticationMethodsReferences: claims.AuthenticationMethodsReferences,
+	}
+}
+
+// isJWT reports whether the token has the three dot-separated segments of a JWS compact serialization.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
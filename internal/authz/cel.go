@@ -0,0 +1,316 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/cel-go/cel"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// CELPolicy is a list of CEL rules guarding chaincode invocations.
+type CELPolicy struct {
+	Rules []CELRule `yaml:"rules"`
+}
+
+// CELRule is a CEL expression that must evaluate to true for a request to be allowed.
+// If When is set, the rule is only enforced for requests where When evaluates to true.
+//
+// Expressions can refer to:
+//
+//	claims    map(string, dyn)  all token claims
+//	subject   string            the token's subject
+//	issuer    string            the token's issuer
+//	scopes    list(string)      the token's scopes
+//	groups    list(string)      the user's groups
+//	request   map(string, string) with keys method, path, channel, chaincode, function and mode
+//	args      list(dyn)         chaincode arguments, parsed as int, double, bool or JSON where possible
+//	raw_args  list(string)      chaincode arguments as sent
+//	now       timestamp         the time of the request
+type CELRule struct {
+	Name       string `yaml:"name"`
+	When       string `yaml:"when"`
+	Expression string `yaml:"expression"`
+	Message    string `yaml:"message"`
+}
+
+// Input is the request a CEL policy is evaluated for.
+type Input struct {
+	Principal Principal
+	Method    string
+	Path      string
+	Request   Request
+}
+
+type celProgram struct {
+	rule CELRule
+	when cel.Program
+	expr cel.Program
+}
+
+// Engine evaluates a CELPolicy loaded from a file. The file is watched and the policy is
+// replaced atomically whenever it changes. A policy that fails to compile is rejected, and the
+// previous one stays in effect.
+type Engine struct {
+	file     string
+	logger   *zap.Logger
+	env      *cel.Env
+	programs atomic.Pointer[[]celProgram]
+}
+
+// NewEngine compiles the CEL policy in file.
+func NewEngine(file string, logger *zap.Logger) (*Engine, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("subject", cel.StringType),
+		cel.Variable("issuer", cel.StringType),
+		cel.Variable("scopes", cel.ListType(cel.StringType)),
+		cel.Variable("groups", cel.ListType(cel.StringType)),
+		cel.Variable("request", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("args", cel.ListType(cel.DynType)),
+		cel.Variable("raw_args", cel.ListType(cel.StringType)),
+		cel.Variable("now", cel.TimestampType),
+		cel.CrossTypeNumericComparisons(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %w", err)
+	}
+
+	e := &Engine{file: file, logger: logger, env: env}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Reload reads and compiles the policy file and, if successful, replaces the active policy.
+func (e *Engine) Reload() error {
+	b, err := os.ReadFile(e.file)
+	if err != nil {
+		return fmt.Errorf("failed to read CEL policy: %w", err)
+	}
+
+	var policy CELPolicy
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		return fmt.Errorf("failed to parse CEL policy: %w", err)
+	}
+
+	programs := make([]celProgram, 0, len(policy.Rules))
+	for i, rule := range policy.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		p := celProgram{rule: rule}
+		if p.expr, err = e.compile(rule.Expression); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		if rule.When != "" {
+			if p.when, err = e.compile(rule.When); err != nil {
+				return fmt.Errorf("rule %s: when: %w", rule.Name, err)
+			}
+		}
+		programs = append(programs, p)
+	}
+
+	e.programs.Store(&programs)
+	return nil
+}
+
+// compile compiles a boolean CEL expression.
+func (e *Engine) compile(expr string) (cel.Program, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, fmt.Errorf("expression is empty")
+	}
+
+	ast, iss := e.env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+
+	if t := ast.OutputType(); !t.IsExactType(cel.BoolType) && !t.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("expression must evaluate to bool, got %s", ast.OutputType())
+	}
+
+	return e.env.Program(ast)
+}
+
+// Watch reloads the policy whenever the policy file changes, until ctx is done. The directory is
+// watched rather than the file, so that ConfigMap updates (which swap a symlink) are noticed.
+func (e *Engine) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch CEL policy: %w", err)
+	}
+
+	if err := watcher.Add(filepath.Dir(e.file)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch CEL policy: %w", err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if err := e.Reload(); err != nil {
+					e.logger.Error("Failed to reload CEL policy, keeping the previous one", zap.String("file", e.file), zap.Error(err))
+					continue
+				}
+				e.logger.Info("CEL policy reloaded", zap.String("file", e.file))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				e.logger.Error("CEL policy watcher error", zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Evaluate enforces every rule that applies to the input. Evaluation errors deny the request.
+func (e *Engine) Evaluate(in Input) Decision {
+	decision := Decision{Request: in.Request}
+	vars := in.activation()
+
+	for _, p := range *e.programs.Load() {
+		result := RuleResult{Rule: p.rule.Name, Effect: "cel"}
+
+		if p.when != nil {
+			applies, err := evalBool(p.when, vars)
+			if err != nil {
+				return deny(decision, result, fmt.Sprintf("rule %s: when: %v", p.rule.Name, err))
+			}
+			if !applies {
+				result.Reason = "rule does not apply"
+				decision.Trace = append(decision.Trace, result)
+				continue
+			}
+		}
+
+		ok, err := evalBool(p.expr, vars)
+		if err != nil {
+			return deny(decision, result, fmt.Sprintf("rule %s: %v", p.rule.Name, err))
+		}
+		if !ok {
+			reason := p.rule.Message
+			if reason == "" {
+				reason = fmt.Sprintf("rule %s: %s is false", p.rule.Name, p.rule.Expression)
+			}
+			return deny(decision, result, reason)
+		}
+
+		result.Matched = true
+		result.Reason = "expression is true"
+		decision.Trace = append(decision.Trace, result)
+	}
+
+	decision.Allowed = true
+	decision.Reason = "all CEL rules passed"
+	return decision
+}
+
+func deny(decision Decision, result RuleResult, reason string) Decision {
+	result.Reason = reason
+	decision.Trace = append(decision.Trace, result)
+	decision.Rule = result.Rule
+	decision.Reason = reason
+	return decision
+}
+
+func evalBool(prg cel.Program, vars map[string]interface{}) (bool, error) {
+	out, _, err := prg.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %T, not bool", out.Value())
+	}
+	return b, nil
+}
+
+// activation returns the CEL variables for the input.
+func (in Input) activation() map[string]interface{} {
+	args := make([]interface{}, len(in.Request.Args))
+	for i, arg := range in.Request.Args {
+		args[i] = typedArg(arg)
+	}
+
+	rawArgs := in.Request.Args
+	if rawArgs == nil {
+		rawArgs = []string{}
+	}
+
+	claims := in.Principal.Claims
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+
+	return map[string]interface{}{
+		"claims":  claims,
+		"subject": in.Principal.Subject,
+		"issuer":  in.Principal.Issuer,
+		"scopes":  nonNil(in.Principal.Scopes),
+		"groups":  nonNil(in.Principal.Groups),
+		"request": map[string]string{
+			"method":    in.Method,
+			"path":      in.Path,
+			"channel":   in.Request.Channel,
+			"chaincode": in.Request.Chaincode,
+			"function":  in.Request.Function,
+			"mode":      in.Request.Mode,
+		},
+		"args":     args,
+		"raw_args": rawArgs,
+		"now":      time.Now(),
+	}
+}
+
+// typedArg interprets a chaincode argument as int, double, bool or JSON, falling back to string.
+func typedArg(arg string) interface{} {
+	if i, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(arg, 64); err == nil {
+		return f
+	}
+	if arg == "true" || arg == "false" {
+		return arg == "true"
+	}
+	if strings.HasPrefix(arg, "{") || strings.HasPrefix(arg, "[") {
+		var v interface{}
+		if err := json.Unmarshal([]byte(arg), &v); err == nil {
+			return v
+		}
+	}
+	return arg
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
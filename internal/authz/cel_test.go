@@ -0,0 +1,160 @@
+package authz
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const testCELPolicy = `
+rules:
+  - name: transfer-limit
+    when: request.function == "Transfer"
+    expression: args[1] <= 1000 || "approvers" in groups
+    message: transfers above 1000 need an approver
+  - name: own-assets
+    when: request.function == "UpdateAsset"
+    expression: args[0].owner == subject
+  - name: verified-email
+    expression: has(claims.email_verified) && claims.email_verified == true
+  - name: evaluate-only-over-get
+    when: request.method == "GET"
+    expression: request.mode == "evaluate"
+`
+
+func TestEngineEvaluate(t *testing.T) {
+	engine, err := NewEngine(writeFile(t, "cel.yaml", testCELPolicy), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verified := map[string]interface{}{"email_verified": true}
+	alice := Principal{Subject: "alice", Claims: verified}
+	approver := Principal{Subject: "bob", Groups: []string{"approvers"}, Claims: verified}
+
+	tests := []struct {
+		name    string
+		in      Input
+		allowed bool
+		rule    string
+		reason  string
+	}{
+		{
+			name:    "within the limit",
+			in:      Input{Principal: alice, Method: "POST", Request: Request{Function: "Transfer", Mode: ModeSubmit, Args: []string{"asset1", "500"}}},
+			allowed: true,
+		},
+		{
+			name:   "above the limit",
+			in:     Input{Principal: alice, Method: "POST", Request: Request{Function: "Transfer", Mode: ModeSubmit, Args: []string{"asset1", "1500.5"}}},
+			rule:   "transfer-limit",
+			reason: "transfers above 1000 need an approver",
+		},
+		{
+			name:    "above the limit by an approver",
+			in:      Input{Principal: approver, Method: "POST", Request: Request{Function: "Transfer", Mode: ModeSubmit, Args: []string{"asset1", "1500"}}},
+			allowed: true,
+		},
+		{
+			name:    "JSON argument",
+			in:      Input{Principal: alice, Method: "POST", Request: Request{Function: "UpdateAsset", Mode: ModeSubmit, Args: []string{`{"owner":"alice"}`}}},
+			allowed: true,
+		},
+		{
+			name:   "JSON argument of another owner",
+			in:     Input{Principal: alice, Method: "POST", Request: Request{Function: "UpdateAsset", Mode: ModeSubmit, Args: []string{`{"owner":"bob"}`}}},
+			rule:   "own-assets",
+			reason: "rule own-assets: args[0].owner == subject is false",
+		},
+		{
+			name:   "missing argument",
+			in:     Input{Principal: alice, Method: "POST", Request: Request{Function: "Transfer", Mode: ModeSubmit}},
+			rule:   "transfer-limit",
+			reason: "rule transfer-limit:",
+		},
+		{
+			name:   "missing claim",
+			in:     Input{Principal: Principal{Subject: "carol"}, Method: "POST", Request: Request{Function: "ReadAsset", Mode: ModeEvaluate}},
+			rule:   "verified-email",
+			reason: "is false",
+		},
+		{
+			name:    "evaluate over GET",
+			in:      Input{Principal: alice, Method: "GET", Path: "/api/v1/mychannel/basic/ReadAsset", Request: Request{Function: "ReadAsset", Mode: ModeEvaluate}},
+			allowed: true,
+		},
+		{
+			name:   "submit over GET",
+			in:     Input{Principal: alice, Method: "GET", Path: "/api/v1/mychannel/basic/DeleteAsset", Request: Request{Function: "DeleteAsset", Mode: ModeSubmit}},
+			rule:   "evaluate-only-over-get",
+			reason: "is false",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := engine.Evaluate(tt.in)
+			if d.Allowed != tt.allowed || d.Rule != tt.rule || !strings.Contains(d.Reason, tt.reason) {
+				t.Errorf("Evaluate() = allowed %v by rule %q (%s), want allowed %v by rule %q (%s)", d.Allowed, d.Rule, d.Reason, tt.allowed, tt.rule, tt.reason)
+			}
+		})
+	}
+}
+
+func TestEngineReload(t *testing.T) {
+	file := writeFile(t, "cel.yaml", "rules: [{expression: 'true'}]")
+	engine, err := NewEngine(file, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []string{
+		"rules: [{name: r, expression: 'subject +'}]", // syntax error
+		"rules: [{name: r, expression: 'subject'}]",   // not bool
+		"rules: [{name: r, expression: ''}]",
+		"rules: [{name: r, when: 'args', expression: 'true'}]",
+	} {
+		if err := os.WriteFile(file, []byte(policy), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := engine.Reload(); err == nil {
+			t.Errorf("Reload() accepted %s", policy)
+		}
+		if !engine.Evaluate(Input{}).Allowed {
+			t.Fatalf("rejected policy %s replaced the previous one", policy)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("rules: [{expression: 'false'}]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if engine.Evaluate(Input{}).Allowed {
+		t.Error("reloaded policy not in effect")
+	}
+}
+
+func TestTypedArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want interface{}
+	}{
+		{"42", int64(42)},
+		{"-1", int64(-1)},
+		{"1.5", 1.5},
+		{"true", true},
+		{"false", false},
+		{"asset1", "asset1"},
+		{"{not json", "{not json"},
+	}
+
+	for _, tt := range tests {
+		if got := typedArg(tt.arg); got != tt.want {
+			t.Errorf("typedArg(%q) = %#v, want %#v", tt.arg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package authz
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Modes of invoking a chaincode function.
+const (
+	ModeSubmit   = "submit"
+	ModeEvaluate = "evaluate"
+)
+
+// Effects of a policy rule.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Policy is an ordered list of allow and deny rules. A request is allowed if at least one allow
+// rule and no deny rule matches it.
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule grants or denies a set of principals access to a set of resources.
+// A rule applies to a principal if every selector that is set matches: the principal holds one of
+// Scopes, is member of one of Groups, and every claim in Claims matches. A rule without selectors
+// applies to everyone.
+type Rule struct {
+	Name      string            `yaml:"name"`
+	Effect    string            `yaml:"effect"`
+	Scopes    []string          `yaml:"scopes"`
+	Groups    []string          `yaml:"groups"`
+	Claims    map[string]string `yaml:"claims"` // claim path (see util.Jq) to glob pattern
+	Resources []Resource        `yaml:"resources"`
+}
+
+// Resource is a chaincode function reachable through the proxy. Fields are glob patterns
+// (see path.Match); empty fields match anything.
+type Resource struct {
+	Channel   string `yaml:"channel"`
+	Chaincode string `yaml:"chaincode"`
+	Function  string `yaml:"function"`
+	Mode      string `yaml:"mode"`
+}
+
+// Request describes the chaincode function a principal wants to invoke.
+type Request struct {
+	Channel   string   `json:"channel"`
+	Chaincode string   `json:"chaincode"`
+	Function  string   `json:"function"`
+	Mode      string   `json:"mode"`
+	Args      []string `json:"args,omitempty"`
+	// Method and Path of the HTTP request invoking the function, as seen by CEL rules
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// Decision is the outcome of evaluating a policy, including the reasoning behind it.
+type Decision struct {
+	Allowed bool         `json:"allowed"`
+	Reason  string       `json:"reason"`
+	Rule    string       `json:"rule,omitempty"`
+	Request Request      `json:"request"`
+	Trace   []RuleResult `json:"trace,omitempty"`
+}
+
+// RuleResult explains whether a single rule matched the request.
+type RuleResult struct {
+	Rule    string `json:"rule"`
+	Effect  string `json:"effect"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason"`
+}
+
+// LoadPolicy reads a policy from a YAML or JSON file.
+func LoadPolicy(file string) (*Policy, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorization policy: %w", err)
+	}
+
+	var policy Policy
+	if err := yaml.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse authorization policy: %w", err)
+	}
+
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// validate checks rule effects and glob patterns, so that mistakes surface on load instead of
+// silently never matching.
+func (p *Policy) validate() error {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		rule.Effect = strings.ToLower(rule.Effect)
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return fmt.Errorf("rule %s: effect must be %q or %q", rule.Name, EffectAllow, EffectDeny)
+		}
+
+		if len(rule.Resources) == 0 {
+			return fmt.Errorf("rule %s: at least one resource is required", rule.Name)
+		}
+
+		patterns := make([]string, 0, len(rule.Claims)+4*len(rule.Resources))
+		for _, pattern := range rule.Claims {
+			patterns = append(patterns, pattern)
+		}
+		for _, res := range rule.Resources {
+			patterns = append(patterns, res.Channel, res.Chaincode, res.Function, res.Mode)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %s: invalid pattern %q: %w", rule.Name, pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Evaluate decides whether the principal may perform the request. Deny rules take precedence over
+// allow rules. A nil policy allows every request.
+func (p *Policy) Evaluate(principal Principal, req Request) Decision {
+	decision := Decision{Request: req}
+	if p == nil {
+		decision.Allowed = true
+		decision.Reason = "no authorization policy configured"
+		return decision
+	}
+
+	var allowedBy, deniedBy string
+	for _, rule := range p.Rules {
+		result := rule.match(principal, req)
+		decision.Trace = append(decision.Trace, result)
+		if !result.Matched {
+			continue
+		}
+
+		switch {
+		case rule.Effect == EffectDeny && deniedBy == "":
+			deniedBy = rule.Name
+		case rule.Effect == EffectAllow && allowedBy == "":
+			allowedBy = rule.Name
+		}
+	}
+
+	switch {
+	case deniedBy != "":
+		decision.Rule = deniedBy
+		decision.Reason = fmt.Sprintf("denied by rule %s", deniedBy)
+	case allowedBy != "":
+		decision.Allowed = true
+		decision.Rule = allowedBy
+		decision.Reason = fmt.Sprintf("allowed by rule %s", allowedBy)
+	default:
+		decision.Reason = "no rule allows the request"
+	}
+
+	return decision
+}
+
+// match reports whether the rule applies to the principal and the request.
+func (r Rule) match(principal Principal, req Request) RuleResult {
+	result := RuleResult{Rule: r.Name, Effect: r.Effect}
+
+	if len(r.Scopes) > 0 && !containsAny(principal.Scopes, r.Scopes) {
+		result.Reason = fmt.Sprintf("token has none of the scopes %v", r.Scopes)
+		return result
+	}
+
+	if len(r.Groups) > 0 && !containsAny(principal.Groups, r.Groups) {
+		result.Reason = fmt.Sprintf("user is in none of the groups %v", r.Groups)
+		return result
+	}
+
+	for claim, pattern := range r.Claims {
+		value, ok := principal.Claim(claim)
+		if !ok || !glob(pattern, value) {
+			result.Reason = fmt.Sprintf("claim %s does not match %q", claim, pattern)
+			return result
+		}
+	}
+
+	for _, res := range r.Resources {
+		if res.match(req) {
+			result.Matched = true
+			result.Reason = fmt.Sprintf("matches %s/%s/%s (%s)",
+				orAny(res.Channel), orAny(res.Chaincode), orAny(res.Function), orAny(res.Mode))
+			return result
+		}
+	}
+
+	result.Reason = "no resource matches the request"
+	return result
+}
+
+func (res Resource) match(req Request) bool {
+	return glob(res.Channel, req.Channel) &&
+		glob(res.Chaincode, req.Chaincode) &&
+		glob(res.Function, req.Function) &&
+		glob(res.Mode, req.Mode)
+}
+
+// glob matches value against a path.Match pattern. An empty pattern matches anything.
+func glob(pattern, value string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
+
+func orAny(pattern string) string {
+	if pattern == "" {
+		return "*"
+	}
+	return pattern
+}
+
+func containsAny(have, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package authz
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+rules:
+  - name: readers
+    effect: allow
+    scopes: [ledger.read]
+    resources:
+      - channel: mychannel
+        mode: evaluate
+  - name: traders
+    effect: allow
+    groups: [traders]
+    resources:
+      - channel: mychannel
+        chaincode: asset*
+  - name: org1-admins
+    effect: allow
+    claims:
+      org: org1
+      role: admin*
+    resources:
+      - {}
+  - name: no-deletes
+    effect: deny
+    resources:
+      - chaincode: asset*
+        function: Delete*
+        mode: submit
+`
+
+// writeFile writes content to name in a new temporary directory and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestEvaluate(t *testing.T) {
+	policy, err := LoadPolicy(writeFile(t, "policy.yaml", testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := Principal{Subject: "alice", Scopes: []string{"ledger.read"}}
+	trader := Principal{Subject: "bob", Groups: []string{"traders"}}
+	admin := Principal{Subject: "carol", Claims: map[string]interface{}{"org": "org1", "role": "administrator"}}
+
+	tests := []struct {
+		name      string
+		principal Principal
+		req       Request
+		allowed   bool
+		rule      string
+	}{
+		{"scope allows evaluate", reader, Request{Channel: "mychannel", Chaincode: "basic", Mode: ModeEvaluate}, true, "readers"},
+		{"scope does not allow submit", reader, Request{Channel: "mychannel", Chaincode: "basic", Mode: ModeSubmit}, false, ""},
+		{"scope does not allow other channels", reader, Request{Channel: "other", Mode: ModeEvaluate}, false, ""},
+		{"group allows matching chaincode", trader, Request{Channel: "mychannel", Chaincode: "asset-transfer", Function: "Transfer", Mode: ModeSubmit}, true, "traders"},
+		{"group does not allow other chaincode", trader, Request{Channel: "mychannel", Chaincode: "basic", Mode: ModeSubmit}, false, ""},
+		{"deny overrides allow", trader, Request{Channel: "mychannel", Chaincode: "asset-transfer", Function: "DeleteAsset", Mode: ModeSubmit}, false, "no-deletes"},
+		{"deny limited to its mode", trader, Request{Channel: "mychannel", Chaincode: "asset-transfer", Function: "DeleteAsset", Mode: ModeEvaluate}, true, "traders"},
+		{"claims allow anything", admin, Request{Channel: "other", Chaincode: "basic", Function: "Init", Mode: ModeSubmit}, true, "org1-admins"},
+		{"deny overrides allow of claims", admin, Request{Channel: "other", Chaincode: "asset1", Function: "DeleteAll", Mode: ModeSubmit}, false, "no-deletes"},
+		{"claim mismatch", Principal{Claims: map[string]interface{}{"org": "org2", "role": "admin"}}, Request{Channel: "mychannel", Mode: ModeSubmit}, false, ""},
+		{"missing claim", Principal{Claims: map[string]interface{}{"org": "org1"}}, Request{Channel: "mychannel", Mode: ModeSubmit}, false, ""},
+		{"no rule applies", Principal{Subject: "dave"}, Request{Channel: "mychannel", Mode: ModeEvaluate}, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := policy.Evaluate(tt.principal, tt.req)
+			if d.Allowed != tt.allowed || d.Rule != tt.rule {
+				t.Errorf("Evaluate() = allowed %v by rule %q (%s), want allowed %v by rule %q", d.Allowed, d.Rule, d.Reason, tt.allowed, tt.rule)
+			}
+			if len(d.Trace) != len(policy.Rules) {
+				t.Errorf("trace has %d results, want one per rule", len(d.Trace))
+			}
+		})
+	}
+}
+
+func TestEvaluateNilPolicy(t *testing.T) {
+	var policy *Policy
+	if d := policy.Evaluate(Principal{}, Request{Channel: "mychannel"}); !d.Allowed {
+		t.Errorf("nil policy denied the request: %s", d.Reason)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{"valid", testPolicy, ""},
+		{"effect is case insensitive", "rules: [{effect: Deny, resources: [{}]}]", ""},
+		{"unknown effect", "rules: [{name: r, effect: permit, resources: [{}]}]", "rule r: effect must be"},
+		{"no resources", "rules: [{name: r, effect: allow}]", "rule r: at least one resource is required"},
+		{"unnamed rule", "rules: [{effect: allow}]", "rule rule-0:"},
+		{"invalid resource pattern", "rules: [{name: r, effect: allow, resources: [{chaincode: '[a'}]}]", "rule r: invalid pattern"},
+		{"invalid claim pattern", "rules: [{name: r, effect: allow, claims: {org: '[a'}, resources: [{}]}]", "rule r: invalid pattern"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadPolicy(writeFile(t, "policy.yaml", tt.policy))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("LoadPolicy: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("LoadPolicy: %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
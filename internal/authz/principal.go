@@ -0,0 +1,74 @@
+package authz
+
+import (
+	"fmt"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/auth"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/util"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// Principal is the authenticated user a policy is evaluated for.
+type Principal struct {
+	Subject string                 `json:"sub"`
+	Issuer  string                 `json:"iss"`
+	Scopes  []string               `json:"scopes,omitempty"`
+	Groups  []string               `json:"groups,omitempty"`
+	Claims  map[string]interface{} `json:"-"`
+}
+
+// NewPrincipal builds the Principal of an OIDC user, reading its groups from groupsClaim.
+func NewPrincipal(user *oidc.IntrospectionResponse, groupsClaim string) (Principal, error) {
+	claims, err := auth.AllClaims(user)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	p := Principal{
+		Subject: user.Subject,
+		Issuer:  user.Issuer,
+		Scopes:  user.Scope,
+		Claims:  claims,
+	}
+
+	if groupsClaim == "" {
+		return p, nil
+	}
+
+	groups, err := util.Jq(claims, groupsClaim)
+	if err != nil {
+		return p, nil
+	}
+
+	switch g := groups.(type) {
+	case nil:
+	case string:
+		p.Groups = []string{g}
+	case []interface{}:
+		for _, group := range g {
+			p.Groups = append(p.Groups, fmt.Sprint(group))
+		}
+	case map[string]interface{}:
+		// e.g. ZITADEL's urn:zitadel:iam:org:project:roles claim, keyed by role name
+		for group := range g {
+			p.Groups = append(p.Groups, group)
+		}
+	default:
+		return p, fmt.Errorf("groups claim %s has unsupported type %T", groupsClaim, groups)
+	}
+
+	return p, nil
+}
+
+// Claim returns the claim at path as a string.
+func (p Principal) Claim(path string) (string, bool) {
+	value, err := util.Jq(p.Claims, path)
+	if err != nil || value == nil {
+		return "", false
+	}
+
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	return fmt.Sprint(value), true
+}
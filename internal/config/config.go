@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -14,10 +15,21 @@ import (
 
 // Config represents the configuration for fabric-oidc-proxy
 type Config struct {
-	OIDC     OIDCConfig   `mapstructure:"oidc"`
-	LogLevel string       `mapstructure:"loglevel"`
-	HTTP     HTTPConfig   `mapstructure:"http"`
-	Fabric   FabricConfig `mapstructure:"fabric"`
+	OIDC     OIDCConfig    `mapstructure:"oidc"`
+	LogLevel string        `mapstructure:"loglevel"`
+	HTTP     HTTPConfig    `mapstructure:"http"`
+	Fabric   FabricConfig  `mapstructure:"fabric"`
+	Authz    AuthzConfig   `mapstructure:"authz"`
+	Metrics  MetricsConfig `mapstructure:"metrics"`
+	Tracing  TracingConfig `mapstructure:"tracing"`
+	Audit    AuditConfig   `mapstructure:"audit"`
+	Health   HealthConfig  `mapstructure:"health"`
+	// Idempotency configures the Idempotency-Key header of submit-transaction
+	Idempotency IdempotencyConfig `mapstructure:"idempotency"`
+	// RateLimits configures the rate limits and quotas of API requests
+	RateLimits RateLimitsConfig `mapstructure:"rate_limits"`
+	// ServiceAccounts configures OAuth2 clients authenticating with client-credentials tokens
+	ServiceAccounts []ServiceAccountConfig `mapstructure:"service_accounts"`
 }
 
 // OIDCConfig represents the configuration for OIDC
@@ -25,21 +37,345 @@ type OIDCConfig struct {
 	Issuer       string `mapstructure:"issuer"`
 	ClientID     string `mapstructure:"client_id"`
 	ClientSecret string `mapstructure:"client_secret"`
+	// Verification selects how bearer tokens are verified. "introspect" (default) calls the
+	// issuer's introspection endpoint for every request. "jwt" validates JWT access tokens
+	// locally against the issuer's JWKS and only introspects opaque tokens.
+	Verification string        `mapstructure:"verification"`
+	Audience     string        `mapstructure:"audience"`     // expected aud of JWT access tokens, defaults to ClientID
+	SigningAlgs  []string      `mapstructure:"signing_algs"` // accepted JWS algorithms, defaults to the issuer's discovery document
+	ClockSkew    time.Duration `mapstructure:"clock_skew"`   // tolerance applied to exp and nbf
+	// Issuers lists further trusted issuers, e.g. the IdPs of partner organizations.
+	// The issuer of a token is selected by its iss claim.
+	Issuers []IssuerConfig `mapstructure:"issuers"`
+	// Session enables browser login against Issuer through /auth/login
+	Session SessionConfig `mapstructure:"session"`
+}
+
+// SessionConfig represents the configuration for browser sessions established with the
+// authorization code flow with PKCE. Sessions are disabled unless RedirectURI is set.
+type SessionConfig struct {
+	RedirectURI        string   `mapstructure:"redirect_uri"` // the proxy's /auth/callback URL as registered with the issuer
+	Scopes             []string `mapstructure:"scopes"`
+	Secret             string   `mapstructure:"secret"`   // the keys signing and encrypting session cookies are derived from it
+	Insecure           bool     `mapstructure:"insecure"` // allow session cookies over plain HTTP, for local development only
+	PostLoginRedirect  string   `mapstructure:"post_login_redirect"`
+	PostLogoutRedirect string   `mapstructure:"post_logout_redirect"`
+}
+
+// IssuerConfig represents a trusted OIDC issuer
+type IssuerConfig struct {
+	Issuer       string   `mapstructure:"issuer"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	Audience     string   `mapstructure:"audience"`
+	SigningAlgs  []string `mapstructure:"signing_algs"`
+	// Claims maps the issuer's token claims onto what the proxy expects
+	Claims ClaimMapping `mapstructure:"claims"`
+	// AffiliationPrefix restricts the Fabric affiliation users of this issuer may register with
+	AffiliationPrefix string `mapstructure:"affiliation_prefix"`
+	// TrustFabricClaim lets the fabric claim choose the identity type, hf.* attributes and max
+	// enrollments. Users of other issuers in oidc.issuers are registered as clients without them.
+	TrustFabricClaim bool `mapstructure:"trust_fabric_claim"`
+	// Namespace separates identities of this issuer from those of other issuers.
+	// It is appended to the enrollment ID (<subject>@<namespace>) and used as storage directory.
+	// It must be unique, and is required for every issuer but the first.
+	Namespace string `mapstructure:"namespace"`
+}
+
+// ClaimMapping holds the paths (see util.Jq) of the claims the proxy reads from a token
+type ClaimMapping struct {
+	Subject string `mapstructure:"subject"` // claim used as subject, defaults to sub
+	Fabric  string `mapstructure:"fabric"`  // claim holding the Fabric registration request, defaults to fabric.ca.oidc_claim_key
+	Groups  string `mapstructure:"groups"`  // claim holding the user's groups, defaults to authz.groups_claim
+}
+
+// TrustedIssuers returns all trusted issuers, starting with the one configured by the top-level oidc.* keys.
+func (c OIDCConfig) TrustedIssuers() []IssuerConfig {
+	var issuers []IssuerConfig
+	if c.Issuer != "" {
+		issuers = append(issuers, IssuerConfig{
+			Issuer:       c.Issuer,
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			Audience:     c.Audience,
+			SigningAlgs:  c.SigningAlgs,
+			// the organization's own IdP
+			TrustFabricClaim: true,
+		})
+	}
+	return append(issuers, c.Issuers...)
+}
+
+// TrustedIssuer returns the configuration of the trusted issuer iss. If only one issuer is
+// trusted, it is returned regardless of iss, since introspection responses may omit the iss claim.
+func (c OIDCConfig) TrustedIssuer(iss string) (IssuerConfig, bool) {
+	issuers := c.TrustedIssuers()
+	for _, issuer := range issuers {
+		if issuer.Issuer == iss {
+			return issuer, true
+		}
+	}
+
+	if len(issuers) == 1 {
+		return issuers[0], true
+	}
+
+	return IssuerConfig{}, false
 }
 
 // HTTPConfig represents the configuration for the HTTP server
 type HTTPConfig struct {
-	Port int `mapstructure:"port"`
-	TLS  struct {
-		Cert string `mapstructure:"cert"`
-		Key  string `mapstructure:"key"`
-	} `mapstructure:"tls"`
+	Port  int       `mapstructure:"port"`
+	TLS   TLSConfig `mapstructure:"tls"`
+	HTTP2 bool      `mapstructure:"http2"` // serve HTTP/2 over TLS
+	H2C   bool      `mapstructure:"h2c"`   // serve HTTP/2 without TLS, e.g. behind a TLS terminating load balancer
+	// ShutdownDelay is how long /readyz reports not ready before the listener closes on shutdown,
+	// giving load balancers time to stop routing requests to the proxy
+	ShutdownDelay time.Duration `mapstructure:"shutdown_delay"`
+}
+
+// TLSConfig represents the configuration for serving HTTPS. HTTPS is enabled if Cert and Key are set.
+// The certificate is reloaded whenever the files change.
+type TLSConfig struct {
+	Cert         string           `mapstructure:"cert"`
+	Key          string           `mapstructure:"key"`
+	MinVersion   string           `mapstructure:"min_version"`   // 1.2 (default) or 1.3
+	CipherSuites []string         `mapstructure:"cipher_suites"` // TLS 1.2 cipher suites by name; Go's defaults if empty
+	ClientAuth   ClientAuthConfig `mapstructure:"client_auth"`
+}
+
+// ClientCertIssuer is the issuer of users authenticated by a TLS client certificate.
+const ClientCertIssuer = "urn:fabric-oidc-proxy:client-certificate"
+
+// ClientAuthConfig represents client certificate authentication, for systems that cannot obtain
+// OIDC tokens. It is enabled by setting CA. Certificate users are registered with the Fabric CA
+// as configured here, like service accounts.
+type ClientAuthConfig struct {
+	CA       string `mapstructure:"ca"`       // PEM bundle of the CAs issuing client certificates
+	Required bool   `mapstructure:"required"` // reject connections without a client certificate, disabling OIDC
+	// Subject is the certificate field mapped to the user's subject: cn (default), dn, email, dns or uri
+	Subject   string `mapstructure:"subject"`
+	Namespace string `mapstructure:"namespace"` // required, enrollment IDs are <subject>@<namespace>
+	// Fabric registration of certificate users
+	Type           string        `mapstructure:"type"` // defaults to client
+	Affiliation    string        `mapstructure:"affiliation"`
+	Attributes     []CAAttribute `mapstructure:"attributes"`
+	MaxEnrollments int           `mapstructure:"max_enrollments"`
+}
+
+// Enabled reports whether client certificate authentication is configured.
+func (c ClientAuthConfig) Enabled() bool {
+	return c.CA != ""
+}
+
+// TrustedIssuer returns the configuration of the issuer that authenticated a user. Users
+// authenticated by a client certificate belong to a pseudo issuer derived from http.tls.client_auth.
+func (c *Config) TrustedIssuer(iss string) (IssuerConfig, bool) {
+	if iss == ClientCertIssuer {
+		clientAuth := c.HTTP.TLS.ClientAuth
+		if !clientAuth.Enabled() {
+			return IssuerConfig{}, false
+		}
+		return IssuerConfig{
+			Issuer:            ClientCertIssuer,
+			Claims:            ClaimMapping{Fabric: "fabric", Groups: "ou"},
+			AffiliationPrefix: clientAuth.Affiliation,
+			Namespace:         clientAuth.Namespace,
+		}, true
+	}
+
+	return c.OIDC.TrustedIssuer(iss)
+}
+
+// AuthzConfig represents the configuration for request authorization
+type AuthzConfig struct {
+	PolicyFile  string `mapstructure:"policy_file"`  // YAML or JSON authorization policy; all requests are allowed if unset
+	GroupsClaim string `mapstructure:"groups_claim"` // claim holding the user's groups
+	// CELPolicyFile holds CEL rules evaluated before endorsement; it is reloaded when it changes
+	CELPolicyFile string `mapstructure:"cel_policy_file"`
+}
+
+// MetricsConfig represents the configuration of the Prometheus metrics endpoint
+type MetricsConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Path    string `mapstructure:"path"` // served without authentication
+}
+
+// TracingConfig represents the configuration of OpenTelemetry tracing
+type TracingConfig struct {
+	Exporter    string  `mapstructure:"exporter"`     // otlp or stdout; tracing is disabled if unset
+	Endpoint    string  `mapstructure:"endpoint"`     // OTLP gRPC endpoint, defaults to OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317
+	Insecure    bool    `mapstructure:"insecure"`     // connect to the OTLP endpoint without TLS
+	ServiceName string  `mapstructure:"service_name"` // service.name resource attribute
+	SampleRatio float64 `mapstructure:"sample_ratio"` // ratio of traces sampled unless the caller decided
+}
+
+// AuditConfig represents the configuration of the audit log
+type AuditConfig struct {
+	File string `mapstructure:"file"` // JSON lines file appended to; auditing is disabled if unset
+	// CheckpointInterval is how often the hash chain is signed by the admin identity of the default organization
+	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval"`
+}
+
+// IdempotencyConfig represents the storage of submit outcomes by idempotency key. Outcomes are
+// stored with the user's identity, so replicas sharing fabric.ca.client_home share them.
+type IdempotencyConfig struct {
+	TTL   time.Duration `mapstructure:"ttl"`   // how long outcomes are replayed
+	Lease time.Duration `mapstructure:"lease"` // after which a submit that never completed, e.g. of a crashed replica, is abandoned
+	Wait  time.Duration `mapstructure:"wait"`  // how long a repeated request waits for the one in flight
+}
+
+// HealthConfig represents the configuration of the /readyz readiness checks
+type HealthConfig struct {
+	Timeout    time.Duration `mapstructure:"timeout"`      // deadline of all checks of a probe
+	JWKSMaxAge time.Duration `mapstructure:"jwks_max_age"` // age after which an issuer's JWKS counts as stale
+}
+
+// ServiceAccountConfig represents an OAuth2 client using the client-credentials grant. Instead of
+// reading a registration claim from the token, the proxy registers the client with the Fabric CA
+// as configured here, enrolls it on first use and keeps its identity custodially.
+type ServiceAccountConfig struct {
+	ClientID string `mapstructure:"client_id"` // matched against the token's sub and client_id (or azp)
+	Issuer   string `mapstructure:"issuer"`    // restricts the match to one trusted issuer; required if several are trusted
+	// Fabric registration of the service account
+	Type           string          `mapstructure:"type"` // defaults to client
+	Affiliation    string          `mapstructure:"affiliation"`
+	Attributes     []CAAttribute   `mapstructure:"attributes"`
+	MaxEnrollments int             `mapstructure:"max_enrollments"`    // -1 for unlimited re-enrollment
+	Profile        string          `mapstructure:"enrollment_profile"` // CA signing profile, e.g. one issuing long-lived certificates
+	RenewBefore    time.Duration   `mapstructure:"renew_before"`       // re-enroll when the certificate expires within this period
+	RateLimit      RateLimitConfig `mapstructure:"rate_limit"`         // overrides rate_limits.enroll, evaluate and submit
+}
+
+// CAAttribute represents an attribute of a Fabric CA identity
+type CAAttribute struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+	ECert bool   `mapstructure:"ecert"`
+}
+
+// RateLimitConfig represents a token bucket refilled with RPS tokens per second, holding up to Burst
+// tokens. Burst defaults to RPS rounded up. An RPS of 0 leaves requests unlimited, except in
+// overrides, where 0 keeps the limit overridden and -1 lifts it.
+type RateLimitConfig struct {
+	RPS   float64 `mapstructure:"rps"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// RateLimitsConfig represents the rate limits of API requests. Requests are limited per user,
+// OAuth2 client and route, with separate budgets for enroll, evaluate and submit requests.
+type RateLimitsConfig struct {
+	Enroll   RateLimitConfig `mapstructure:"enroll"`
+	Evaluate RateLimitConfig `mapstructure:"evaluate"`
+	Submit   RateLimitConfig `mapstructure:"submit"`
+	// DailySubmitQuota limits the submits per user and UTC day, by Fabric identity type, e.g. client
+	DailySubmitQuota map[string]int `mapstructure:"daily_submit_quota"`
+	// Groups override the limits for members of a group, read from the groups claim; the first matching entry applies
+	Groups []GroupRateLimitsConfig `mapstructure:"groups"`
+}
+
+// GroupRateLimitsConfig represents the rate limits of the members of a group. Unset limits and
+// quotas are those of rate_limits.
+type GroupRateLimitsConfig struct {
+	Group            string          `mapstructure:"group"`
+	Enroll           RateLimitConfig `mapstructure:"enroll"`
+	Evaluate         RateLimitConfig `mapstructure:"evaluate"`
+	Submit           RateLimitConfig `mapstructure:"submit"`
+	DailySubmitQuota map[string]int  `mapstructure:"daily_submit_quota"` // -1 lifts the quota of an identity type
+}
+
+// ServiceAccount returns the service account a token with the given issuer, subject and client ID
+// belongs to. Both the subject and the client ID must be the service account's client ID.
+func (c *Config) ServiceAccount(iss, sub, clientID string) (ServiceAccountConfig, bool) {
+	// service accounts are OAuth2 clients, a certificate subject never matches one
+	if iss == ClientCertIssuer {
+		return ServiceAccountConfig{}, false
+	}
+
+	for _, sa := range c.ServiceAccounts {
+		if sa.ClientID == sub && sa.ClientID == clientID && (sa.Issuer == "" || sa.Issuer == iss) {
+			return sa, true
+		}
+	}
+	return ServiceAccountConfig{}, false
 }
 
 // FabricConfig represents the configuration for the Fabric client
 type FabricConfig struct {
 	CA FabricCAConfig `mapstructure:"ca"`
 	GW FabricGWConfig `mapstructure:"gw"`
+	// Orgs are further organizations served by the proxy. CA and GW above form the default organization.
+	Orgs []OrgConfig `mapstructure:"orgs"`
+	// OrgClaim is the claim naming the organization of a user. Without it, or if the claim is missing,
+	// the organization is selected by the token's issuer.
+	OrgClaim string `mapstructure:"org_claim"`
+	// ConnectionProfile is a Fabric common connection profile (YAML or JSON) providing the MSP ID,
+	// peers and CA of organizations. Explicitly configured values take precedence.
+	ConnectionProfile string `mapstructure:"connection_profile"`
+	// ConnectionProfileOrg is the profile's organization of the default organization, defaults to client.organization
+	ConnectionProfileOrg string `mapstructure:"connection_profile_org"`
+	// Retry configures resubmitting transactions that failed with read conflicts or transient errors
+	Retry RetryConfig `mapstructure:"retry"`
+}
+
+// RetryConfig represents the retry of submitted transactions. Every attempt endorses, submits and
+// awaits the commit of a new transaction; the backoff before attempt n is
+// min(MaxBackoff, InitialBackoff * Multiplier^(n-2)), randomly varied by Jitter.
+type RetryConfig struct {
+	Attempts       int           `mapstructure:"attempts"` // including the first, 1 disables retries
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+	Multiplier     float64       `mapstructure:"multiplier"`
+	Jitter         float64       `mapstructure:"jitter"` // fraction of the backoff, between 0 and 1
+}
+
+// DefaultOrg is the name of the organization configured by fabric.ca and fabric.gw.
+const DefaultOrg = "default"
+
+// OrgConfig represents a member organization with its own CA, MSP and peers.
+type OrgConfig struct {
+	Name    string         `mapstructure:"name"`
+	Issuers []string       `mapstructure:"issuers"` // users of these issuers belong to the organization
+	CA      FabricCAConfig `mapstructure:"ca"`
+	GW      FabricGWConfig `mapstructure:"gw"`
+	// ConnectionProfileOrg imports the organization's settings from fabric.connection_profile
+	ConnectionProfileOrg string `mapstructure:"connection_profile_org"`
+}
+
+// Organizations returns the default organization followed by fabric.orgs. Unset timeouts and
+// claim keys of fabric.orgs default to those of the default organization, and their client home
+// to a subdirectory of its client home.
+func (c FabricConfig) Organizations() []OrgConfig {
+	orgs := []OrgConfig{{Name: DefaultOrg, CA: c.CA, GW: c.GW}}
+	for _, org := range c.Orgs {
+		org.CA.ClientHome = c.orgClientHome(org)
+		if org.CA.OIDCClaimKey == "" {
+			org.CA.OIDCClaimKey = c.CA.OIDCClaimKey
+		}
+		if org.CA.RecoveryMaxEnrollments == 0 {
+			org.CA.RecoveryMaxEnrollments = c.CA.RecoveryMaxEnrollments
+		}
+		if org.GW.Balancing == "" {
+			org.GW.Balancing = c.GW.Balancing
+		}
+		if org.GW.HealthCheckInterval == 0 {
+			org.GW.HealthCheckInterval = c.GW.HealthCheckInterval
+		}
+		if org.GW.HealthCheckTimeout == 0 {
+			org.GW.HealthCheckTimeout = c.GW.HealthCheckTimeout
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs
+}
+
+// orgClientHome returns the client home of an entry of fabric.orgs, defaulting to orgs/<name> in
+// the client home of the default organization, so that organizations never share identities.
+func (c FabricConfig) orgClientHome(org OrgConfig) string {
+	if org.CA.ClientHome != "" || org.Name == "" {
+		return org.CA.ClientHome
+	}
+	return filepath.Join(c.CA.ClientHome, "orgs", org.Name)
 }
 
 // FabricConfig represents the configuration for the Fabric CA client
@@ -53,6 +389,9 @@ type FabricCAConfig struct {
 	Admin           string `mapstructure:"admin"`
 	AdminSecret     string `mapstructure:"admin_secret"`
 	OIDCClaimKey    string `mapstructure:"oidc_claim_key"`
+	// RecoveryMaxEnrollments is set on identities registered before whose MSP was lost when they are
+	// recovered; 0 raises their own limit by one, so that they can enroll once more, -1 lifts it
+	RecoveryMaxEnrollments int `mapstructure:"recovery_max_enrollments"`
 }
 
 // FabricGWConfig represents the configuration for the Fabric Gateway client
@@ -65,6 +404,35 @@ type FabricGWConfig struct {
 	PeerServerNameOverride string `mapstructure:"peer_server_name_override"`
 	MSPCert                string `mapstructure:"msp_cert"`
 	MSPKey                 string `mapstructure:"msp_key"`
+	// Peers lists the gateway peers requests are balanced across; PeerEndpoint is used if empty
+	Peers               []PeerConfig  `mapstructure:"peers"`
+	Balancing           string        `mapstructure:"balancing"` // round_robin (default) or least_latency
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval"`
+	HealthCheckTimeout  time.Duration `mapstructure:"health_check_timeout"`
+}
+
+// PeerConfig represents a gateway peer. TLS settings default to those of fabric.gw.
+type PeerConfig struct {
+	Endpoint           string `mapstructure:"endpoint"`
+	TLSTrustedCerts    string `mapstructure:"tls_trusted_certs"`
+	ServerNameOverride string `mapstructure:"server_name_override"`
+}
+
+// GatewayPeers returns the configured gateway peers, with TLS defaults applied.
+func (c FabricGWConfig) GatewayPeers() []PeerConfig {
+	peers := c.Peers
+	if len(peers) == 0 {
+		peers = []PeerConfig{{Endpoint: c.PeerEndpoint, ServerNameOverride: c.PeerServerNameOverride}}
+	}
+
+	result := make([]PeerConfig, 0, len(peers))
+	for _, peer := range peers {
+		if peer.TLSTrustedCerts == "" {
+			peer.TLSTrustedCerts = c.TLSTrustedCerts
+		}
+		result = append(result, peer)
+	}
+	return result
 }
 
 // LoadConfig loads the configuration from, in order of priority:
@@ -80,72 +448,153 @@ func LoadConfig(cmd *cobra.Command) (*Config, *zap.Logger, error) {
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	// ... other defaults
 
-	// Set configuration file
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".") // Look for config.yaml in the current directory
-
-	// Read configuration file (if it exists)
-	if err := viper.ReadInConfig(); err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
-			return nil, nil, err // Handle other errors (e.g., parsing errors)
-		}
-		// If the file doesn't exist, it's okay, use defaults without config file
+	// Read the configuration file given by --config, or config.{yaml,yml,json,toml} in the current
+	// directory if it exists
+	if err := readConfigFile(viper.GetString("config")); err != nil {
+		return nil, nil, err
 	}
 
 	// Set defaults (use Fabric's defaults where applicable)
 	viper.SetDefault("http.port", 8080)
+	viper.SetDefault("http.http2", true)
+	viper.SetDefault("http.tls.min_version", "1.2")
 	viper.SetDefault("loglevel", "info")
+	viper.SetDefault("oidc.verification", "introspect")
+	viper.SetDefault("oidc.clock_skew", "30s")
+	viper.SetDefault("oidc.session.scopes", []string{"openid", "profile", "email", "offline_access"})
+	viper.SetDefault("oidc.session.post_login_redirect", "/")
+	viper.SetDefault("authz.groups_claim", "groups")
+	viper.SetDefault("metrics.enabled", true)
+	viper.SetDefault("metrics.path", "/metrics")
+	viper.SetDefault("tracing.service_name", "fabric-oidc-proxy")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
+	viper.SetDefault("audit.checkpoint_interval", "5m")
+	viper.SetDefault("health.timeout", "2s")
+	viper.SetDefault("idempotency.ttl", "24h")
+	viper.SetDefault("idempotency.lease", "10m")
+	viper.SetDefault("idempotency.wait", "30s")
+	viper.SetDefault("health.jwks_max_age", "1h")
+	viper.SetDefault("http.shutdown_delay", "5s")
+	viper.SetDefault("http.tls.client_auth.subject", "cn")
 	viper.SetDefault("fabric.ca.url", "http://localhost:7054")
 	viper.SetDefault("fabric.ca.admin", "admin")
 	viper.SetDefault("fabric.ca.admin_secret", "adminpw")
 	viper.SetDefault("fabric.ca.client_mspdir", "msp")
 	viper.SetDefault("fabric.ca.oidc_claim_key", "fabric")
-	// Check if fabric/tls exists, create if not
 	wd, _ := os.Getwd()
 	tlsDirPath := filepath.Join(wd, "fabric", "tls")
-	if _, err := os.Stat(tlsDirPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(tlsDirPath, 0755); err != nil { // Create with appropriate permissions
-			return nil, nil, fmt.Errorf("failed to create fabric/tls directory: %w", err)
-		}
-	}
 	viper.SetDefault("fabric.ca.client_home", "fabric")
 	viper.SetDefault("fabric.ca.tls_trusted_certs", filepath.Join(tlsDirPath, "ca.crt"))
 
 	viper.SetDefault("fabric.gw.msp_id", "Org1MSP")
 	viper.SetDefault("fabric.gw.peer_endpoint", "dns:///127.0.0.1:7051")
 	viper.SetDefault("fabric.gw.peer_server_name_override", "peer0.org1")
+	viper.SetDefault("fabric.gw.balancing", "round_robin")
+	viper.SetDefault("fabric.gw.health_check_interval", "10s")
+	viper.SetDefault("fabric.gw.health_check_timeout", "2s")
+	viper.SetDefault("fabric.retry.attempts", 3)
+	viper.SetDefault("fabric.retry.initial_backoff", "100ms")
+	viper.SetDefault("fabric.retry.max_backoff", "2s")
+	viper.SetDefault("fabric.retry.multiplier", 2.0)
+	viper.SetDefault("fabric.retry.jitter", 0.2)
 	viper.SetDefault("fabric.gw.tls_trusted_certs", filepath.Join(tlsDirPath, "ca.crt"))
 
 	// bind config keys to environment variables
 	viper.BindEnv("oidc.issuer")
 	viper.BindEnv("oidc.client_id")
 	viper.BindEnv("oidc.client_secret")
+	viper.BindEnv("oidc.verification")
+	viper.BindEnv("oidc.audience")
+	viper.BindEnv("oidc.signing_algs")
+	viper.BindEnv("oidc.clock_skew")
+	viper.BindEnv("oidc.session.redirect_uri")
+	viper.BindEnv("oidc.session.scopes")
+	viper.BindEnv("oidc.session.secret")
+	viper.BindEnv("oidc.session.insecure")
+	viper.BindEnv("oidc.session.post_login_redirect")
+	viper.BindEnv("oidc.session.post_logout_redirect")
 
 	viper.BindEnv("loglevel")
 
+	viper.BindEnv("authz.policy_file")
+	viper.BindEnv("authz.groups_claim")
+	viper.BindEnv("authz.cel_policy_file")
+
+	viper.BindEnv("metrics.enabled")
+	viper.BindEnv("metrics.path")
+
+	viper.BindEnv("tracing.exporter")
+	viper.BindEnv("tracing.endpoint")
+	viper.BindEnv("tracing.insecure")
+	viper.BindEnv("tracing.service_name")
+	viper.BindEnv("tracing.sample_ratio")
+
+	viper.BindEnv("audit.file")
+	viper.BindEnv("audit.checkpoint_interval")
+
+	viper.BindEnv("rate_limits.enroll.rps")
+	viper.BindEnv("rate_limits.enroll.burst")
+	viper.BindEnv("rate_limits.evaluate.rps")
+	viper.BindEnv("rate_limits.evaluate.burst")
+	viper.BindEnv("rate_limits.submit.rps")
+	viper.BindEnv("rate_limits.submit.burst")
+
+	viper.BindEnv("idempotency.ttl")
+	viper.BindEnv("idempotency.lease")
+	viper.BindEnv("idempotency.wait")
+
+	viper.BindEnv("health.timeout")
+	viper.BindEnv("health.jwks_max_age")
+
 	viper.BindEnv("http.port")
 	viper.BindEnv("http.tls.cert")
 	viper.BindEnv("http.tls.key")
+	viper.BindEnv("http.tls.min_version")
+	viper.BindEnv("http.tls.cipher_suites")
+	viper.BindEnv("http.http2")
+	viper.BindEnv("http.h2c")
+	viper.BindEnv("http.shutdown_delay")
+	viper.BindEnv("http.tls.client_auth.ca")
+	viper.BindEnv("http.tls.client_auth.required")
+	viper.BindEnv("http.tls.client_auth.subject")
+	viper.BindEnv("http.tls.client_auth.namespace")
+	viper.BindEnv("http.tls.client_auth.type")
+	viper.BindEnv("http.tls.client_auth.affiliation")
+	viper.BindEnv("http.tls.client_auth.max_enrollments")
 
 	viper.BindEnv("fabric.ca.url")
 	viper.BindEnv("fabric.ca.client_home")
 	viper.BindEnv("fabric.ca.client_mspdir")
 	viper.BindEnv("fabric.ca.admin")
 	viper.BindEnv("fabric.ca.admin_secret")
-	viper.BindEnv("fabric.ca.client_tls_cert")
-	viper.BindEnv("fabric.ca.client_tls_key")
+	viper.BindEnv("fabric.ca.tls_cert")
+	viper.BindEnv("fabric.ca.tls_key")
 	viper.BindEnv("fabric.ca.tls_trusted_certs")
 
+	viper.BindEnv("fabric.org_claim")
+	viper.BindEnv("fabric.connection_profile")
+	viper.BindEnv("fabric.connection_profile_org")
+
 	viper.BindEnv("fabric.gw.msp_id")
+	viper.BindEnv("fabric.gw.tls_cert")
+	viper.BindEnv("fabric.gw.tls_key")
 	viper.BindEnv("fabric.gw.tls_trusted_certs")
 	viper.BindEnv("fabric.gw.peer_endpoint")
 	viper.BindEnv("fabric.gw.peer_server_name_override")
 	viper.BindEnv("fabric.gw.msp_cert")
 	viper.BindEnv("fabric.gw.msp_key")
+	viper.BindEnv("fabric.gw.balancing")
+	viper.BindEnv("fabric.gw.health_check_interval")
+	viper.BindEnv("fabric.gw.health_check_timeout")
 
-	var cfg Config
-	if err := viper.Unmarshal(&cfg); err != nil {
+	viper.BindEnv("fabric.retry.attempts")
+	viper.BindEnv("fabric.retry.initial_backoff")
+	viper.BindEnv("fabric.retry.max_backoff")
+	viper.BindEnv("fabric.retry.multiplier")
+	viper.BindEnv("fabric.retry.jitter")
+
+	cfg, err := unmarshal()
+	if err != nil {
 		return nil, nil, err
 	}
 
@@ -155,7 +604,55 @@ func LoadConfig(cmd *cobra.Command) (*Config, *zap.Logger, error) {
 		return nil, nil, err
 	}
 
-	return &cfg, logger, nil
+	return cfg, logger, nil
+}
+
+// unmarshal reads secret files and the connection profile, and decodes the configuration.
+func unmarshal() (*Config, error) {
+	// Secrets may be read from files, e.g. FABRIC_CA_ADMIN_SECRET_FILE=/run/secrets/ca-admin
+	if err := readSecretFiles(); err != nil {
+		return nil, err
+	}
+
+	var profile *ConnectionProfile
+	if file := viper.GetString("fabric.connection_profile"); file != "" {
+		p, err := LoadConnectionProfile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		certDir := filepath.Join(viper.GetString("fabric.ca.client_home"), profileCertDir)
+		settings, err := p.settings(viper.GetString("fabric.connection_profile_org"), certDir)
+		if err != nil {
+			return nil, err
+		}
+		settings.setDefaults()
+		profile = p
+	}
+
+	var cfg Config
+	if err := viper.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Fabric.Orgs {
+		org := &cfg.Fabric.Orgs[i]
+		org.CA.ClientHome = cfg.Fabric.orgClientHome(*org)
+		if org.ConnectionProfileOrg == "" {
+			continue
+		}
+		if profile == nil {
+			return nil, fmt.Errorf("organization %s: connection_profile_org requires fabric.connection_profile", org.Name)
+		}
+
+		settings, err := profile.settings(org.ConnectionProfileOrg, filepath.Join(org.CA.ClientHome, profileCertDir))
+		if err != nil {
+			return nil, fmt.Errorf("organization %s: %w", org.Name, err)
+		}
+		settings.fill(org)
+	}
+
+	return &cfg, nil
 }
 
 // initLogger initializes a zap logger based on the LogLevel in the configuration.
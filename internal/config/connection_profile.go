@@ -0,0 +1,231 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// profileCertDir is the directory below a client home that inline PEMs of a connection profile are written to
+const profileCertDir = "connection-profile"
+
+// ConnectionProfile is a Fabric common connection profile, as published for client applications.
+// Only the parts the proxy needs are read.
+type ConnectionProfile struct {
+	Client struct {
+		Organization string `yaml:"organization"`
+	} `yaml:"client"`
+	Organizations          map[string]profileOrganization `yaml:"organizations"`
+	Peers                  map[string]profilePeer         `yaml:"peers"`
+	CertificateAuthorities map[string]profileCA           `yaml:"certificateAuthorities"`
+}
+
+type profileOrganization struct {
+	MSPID                  string   `yaml:"mspid"`
+	Peers                  []string `yaml:"peers"`
+	CertificateAuthorities []string `yaml:"certificateAuthorities"`
+}
+
+type profilePeer struct {
+	URL         string                 `yaml:"url"`
+	TLSCACerts  profileCerts           `yaml:"tlsCACerts"`
+	GRPCOptions map[string]interface{} `yaml:"grpcOptions"`
+}
+
+type profileCA struct {
+	URL        string       `yaml:"url"`
+	TLSCACerts profileCerts `yaml:"tlsCACerts"`
+	Registrar  struct {
+		EnrollID     string `yaml:"enrollId"`
+		EnrollSecret string `yaml:"enrollSecret"`
+	} `yaml:"registrar"`
+}
+
+// profileCerts holds TLS CA certificates either inline, as one PEM string or a list of them, or as a path.
+type profileCerts struct {
+	PEM  interface{} `yaml:"pem"`
+	Path string      `yaml:"path"`
+}
+
+// profileSettings are the settings of one organization read from a connection profile.
+type profileSettings struct {
+	MSPID         string
+	Peers         []PeerConfig
+	CAURL         string
+	CATLSCerts    string
+	CAAdmin       string
+	CAAdminSecret string
+}
+
+// LoadConnectionProfile reads a connection profile from a YAML or JSON file.
+func LoadConnectionProfile(file string) (*ConnectionProfile, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connection profile: %w", err)
+	}
+
+	var profile ConnectionProfile
+	if err := yaml.Unmarshal(b, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse connection profile: %w", err)
+	}
+
+	return &profile, nil
+}
+
+// settings returns the MSP ID, peers and first CA of an organization in the profile. Inline PEMs
+// are written to certDir, since the Fabric clients read TLS certificates from files.
+func (p *ConnectionProfile) settings(orgName, certDir string) (profileSettings, error) {
+	if orgName == "" {
+		orgName = p.Client.Organization
+	}
+
+	org, ok := p.Organizations[orgName]
+	if !ok {
+		return profileSettings{}, fmt.Errorf("organization %q not found in connection profile", orgName)
+	}
+
+	s := profileSettings{MSPID: org.MSPID}
+
+	for _, name := range org.Peers {
+		peer, ok := p.Peers[name]
+		if !ok {
+			return profileSettings{}, fmt.Errorf("peer %s of organization %s not found in connection profile", name, orgName)
+		}
+
+		certs, err := peer.TLSCACerts.file(certDir, "peer-"+name)
+		if err != nil {
+			return profileSettings{}, fmt.Errorf("peer %s: %w", name, err)
+		}
+
+		s.Peers = append(s.Peers, PeerConfig{
+			Endpoint:           grpcTarget(peer.URL),
+			TLSTrustedCerts:    certs,
+			ServerNameOverride: peer.serverName(),
+		})
+	}
+
+	if len(org.CertificateAuthorities) > 0 {
+		name := org.CertificateAuthorities[0]
+		ca, ok := p.CertificateAuthorities[name]
+		if !ok {
+			return profileSettings{}, fmt.Errorf("certificate authority %s of organization %s not found in connection profile", name, orgName)
+		}
+
+		certs, err := ca.TLSCACerts.file(certDir, "ca-"+name)
+		if err != nil {
+			return profileSettings{}, fmt.Errorf("certificate authority %s: %w", name, err)
+		}
+
+		s.CAURL = ca.URL
+		s.CATLSCerts = certs
+		s.CAAdmin = ca.Registrar.EnrollID
+		s.CAAdminSecret = ca.Registrar.EnrollSecret
+	}
+
+	return s, nil
+}
+
+// file returns the path of a file holding the certificates, writing inline PEMs to certDir/<name>.pem.
+func (c profileCerts) file(certDir, name string) (string, error) {
+	var pems []string
+	switch pem := c.PEM.(type) {
+	case nil:
+		return c.Path, nil
+	case string:
+		pems = []string{pem}
+	case []interface{}:
+		for _, p := range pem {
+			s, ok := p.(string)
+			if !ok {
+				return "", fmt.Errorf("tlsCACerts.pem must be a string or a list of strings")
+			}
+			pems = append(pems, s)
+		}
+	default:
+		return "", fmt.Errorf("tlsCACerts.pem must be a string or a list of strings")
+	}
+
+	if err := os.MkdirAll(certDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for TLS certificates: %w", err)
+	}
+
+	path := filepath.Join(certDir, name+".pem")
+	if err := os.WriteFile(path, []byte(strings.Join(pems, "\n")), 0644); err != nil {
+		return "", fmt.Errorf("failed to write TLS certificates: %w", err)
+	}
+
+	return path, nil
+}
+
+// serverName returns the TLS server name override of a peer, if any.
+func (p profilePeer) serverName() string {
+	for _, key := range []string{"ssl-target-name-override", "hostnameOverride"} {
+		if name, ok := p.GRPCOptions[key].(string); ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// grpcTarget converts a peer URL like grpcs://peer0.org1.example.com:7051 to a gRPC target.
+func grpcTarget(peerURL string) string {
+	u, err := url.Parse(peerURL)
+	if err != nil || u.Host == "" {
+		return peerURL
+	}
+	return "dns:///" + u.Host
+}
+
+// setDefaults makes the settings of the organization the defaults of fabric.ca and fabric.gw, so
+// that explicitly configured values still take precedence.
+func (s profileSettings) setDefaults() {
+	if s.MSPID != "" {
+		viper.SetDefault("fabric.gw.msp_id", s.MSPID)
+	}
+	if len(s.Peers) > 0 {
+		peers := make([]map[string]interface{}, 0, len(s.Peers))
+		for _, peer := range s.Peers {
+			peers = append(peers, map[string]interface{}{
+				"endpoint":             peer.Endpoint,
+				"tls_trusted_certs":    peer.TLSTrustedCerts,
+				"server_name_override": peer.ServerNameOverride,
+			})
+		}
+		viper.SetDefault("fabric.gw.peers", peers)
+	}
+	if s.CAURL != "" {
+		viper.SetDefault("fabric.ca.url", s.CAURL)
+		if s.CATLSCerts != "" {
+			viper.SetDefault("fabric.ca.tls_trusted_certs", s.CATLSCerts)
+		}
+		if s.CAAdmin != "" {
+			viper.SetDefault("fabric.ca.admin", s.CAAdmin)
+			viper.SetDefault("fabric.ca.admin_secret", s.CAAdminSecret)
+		}
+	}
+}
+
+// fill sets the settings of the organization on an entry of fabric.orgs, where not configured.
+func (s profileSettings) fill(org *OrgConfig) {
+	if org.GW.MSPID == "" {
+		org.GW.MSPID = s.MSPID
+	}
+	if len(org.GW.Peers) == 0 && org.GW.PeerEndpoint == "" {
+		org.GW.Peers = s.Peers
+	}
+	if org.CA.URL == "" {
+		org.CA.URL = s.CAURL
+	}
+	if org.CA.TLSTrustedCerts == "" {
+		org.CA.TLSTrustedCerts = s.CATLSCerts
+	}
+	if org.CA.Admin == "" {
+		org.CA.Admin = s.CAAdmin
+		org.CA.AdminSecret = s.CAAdminSecret
+	}
+}
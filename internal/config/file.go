@@ -0,0 +1,131 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// configFileTypes are the supported configuration file formats by extension
+var configFileTypes = map[string]string{
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".json": "json",
+	".toml": "toml",
+}
+
+// configFile is the configuration file read by LoadConfig, if any
+var configFile string
+
+// envRef matches ${VAR} references in configuration files
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// readConfigFile reads the configuration file into viper, expanding ${VAR} references in string
+// values to environment variables. The file is parsed before expanding, so that values cannot
+// change its structure, and references in comments are ignored. Without an explicit file,
+// config.{yaml,yml,json,toml} is looked up in the current directory, and it is fine if there is none.
+func readConfigFile(file string) error {
+	if file == "" {
+		for _, ext := range []string{".yaml", ".yml", ".json", ".toml"} {
+			if _, err := os.Stat("config" + ext); err == nil {
+				file = "config" + ext
+				break
+			}
+		}
+		if file == "" {
+			return nil
+		}
+	}
+
+	configType, ok := configFileTypes[strings.ToLower(filepath.Ext(file))]
+	if !ok {
+		return fmt.Errorf("unsupported config file format %s, use .yaml, .yml, .json or .toml", file)
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	parsed := viper.New()
+	parsed.SetConfigType(configType)
+	if err := parsed.ReadConfig(bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", file, err)
+	}
+
+	var missing []string
+	settings := expandEnvRefs(parsed.AllSettings(), &missing).(map[string]interface{})
+	if len(missing) > 0 {
+		return fmt.Errorf("config file %s refers to unset environment variables %s", file, strings.Join(missing, ", "))
+	}
+
+	// drop the settings of a previous read, so that keys removed from the file are unset on reload
+	viper.SetConfigType("json")
+	if err := viper.ReadConfig(strings.NewReader("{}")); err != nil {
+		return err
+	}
+	if err := viper.MergeConfigMap(settings); err != nil {
+		return fmt.Errorf("failed to merge config file %s: %w", file, err)
+	}
+
+	configFile = file
+	return nil
+}
+
+// expandEnvRefs returns v with ${VAR} references in its strings, including those nested in maps and
+// lists, replaced by environment variables. Unset variables are appended to missing.
+func expandEnvRefs(v interface{}, missing *[]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return envRef.ReplaceAllStringFunc(v, func(ref string) string {
+			name := envRef.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				*missing = append(*missing, name)
+			}
+			return value
+		})
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = expandEnvRefs(value, missing)
+		}
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			v[key] = expandEnvRefs(value, missing)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = expandEnvRefs(value, missing)
+		}
+	}
+	return v
+}
+
+// readSecretFiles sets every configuration key whose environment variable has a _FILE suffixed
+// variant to the content of that file, e.g. OIDC_CLIENT_SECRET_FILE for oidc.client_secret.
+func readSecretFiles() error {
+	for _, key := range viper.AllKeys() {
+		env := strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		file, ok := os.LookupEnv(env + "_FILE")
+		if !ok {
+			continue
+		}
+
+		if _, ok := os.LookupEnv(env); ok {
+			return fmt.Errorf("only one of %s and %s_FILE may be set", env, env)
+		}
+
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %w", env, err)
+		}
+		viper.Set(key, strings.TrimRight(string(b), "\r\n"))
+	}
+
+	return nil
+}
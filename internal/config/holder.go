@@ -0,0 +1,282 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// Reloader prepares applying a new configuration. It returns an error if the configuration cannot
+// be applied, or a function applying it, which is only called once every Reloader has accepted it.
+type Reloader func(old, new *Config) (apply func(), err error)
+
+// Holder holds the current configuration. Readers call Load for every request, so that they see
+// a reloaded configuration as a whole or not at all.
+type Holder struct {
+	current   atomic.Pointer[Config]
+	mu        sync.Mutex // serializes reloads
+	reloaders []Reloader
+	logger    *zap.Logger
+}
+
+// NewHolder returns a Holder of the loaded configuration.
+func NewHolder(conf *Config, logger *zap.Logger) *Holder {
+	h := &Holder{logger: logger}
+	h.current.Store(conf)
+	return h
+}
+
+// Load returns the current configuration. It must not be modified.
+func (h *Holder) Load() *Config {
+	return h.current.Load()
+}
+
+// OnReload registers a Reloader, called in order of registration.
+func (h *Holder) OnReload(r Reloader) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reloaders = append(h.reloaders, r)
+}
+
+// Reload reads the configuration again, validates it and, if every Reloader accepts it, replaces
+// the current configuration. Settings that cannot change while running keep their value until
+// restart, which is logged.
+func (h *Holder) Reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := readConfigFile(configFile); err != nil {
+		return err
+	}
+
+	next, err := unmarshal()
+	if err != nil {
+		return err
+	}
+
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	old := h.Load()
+	for _, key := range keepRestartOnly(old, next) {
+		h.logger.Warn("Configuration change requires a restart to take effect", zap.String("key", key))
+	}
+
+	applies := make([]func(), 0, len(h.reloaders))
+	for _, reload := range h.reloaders {
+		apply, err := reload(old, next)
+		if err != nil {
+			return err
+		}
+		applies = append(applies, apply)
+	}
+
+	h.current.Store(next)
+	for _, apply := range applies {
+		if apply != nil {
+			apply()
+		}
+	}
+
+	return nil
+}
+
+// Watch reloads the configuration on SIGHUP and whenever the configuration file changes, until ctx
+// is done. A configuration that fails to load or validate is logged and the current one is kept.
+func (h *Holder) Watch(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events chan fsnotify.Event
+	var watcher *fsnotify.Watcher
+	if configFile != "" {
+		var err error
+		watcher, err = fsnotify.NewWatcher()
+		if err != nil {
+			signal.Stop(hup)
+			return fmt.Errorf("failed to watch config file: %w", err)
+		}
+
+		// the directory is watched, so that ConfigMap updates (which swap a symlink) are noticed
+		if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+			signal.Stop(hup)
+			watcher.Close()
+			return fmt.Errorf("failed to watch config file: %w", err)
+		}
+		events = watcher.Events
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		if watcher != nil {
+			defer watcher.Close()
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				h.reload("SIGHUP")
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				h.reload("config file changed")
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (h *Holder) reload(reason string) {
+	if err := h.Reload(); err != nil {
+		h.logger.Error("Failed to reload configuration, keeping the current one", zap.String("reason", reason), zap.Error(err))
+		return
+	}
+	h.logger.Info("Configuration reloaded", zap.String("reason", reason))
+}
+
+// keepRestartOnly copies settings that are only applied at startup from old to next, and returns
+// the keys of those that changed.
+func keepRestartOnly(old, next *Config) []string {
+	var changed []string
+	keep := func(key string, oldValue, nextValue interface{}, restore func()) {
+		if !reflect.DeepEqual(oldValue, nextValue) {
+			changed = append(changed, key)
+			restore()
+		}
+	}
+
+	keep("loglevel", old.LogLevel, next.LogLevel, func() { next.LogLevel = old.LogLevel })
+	keep("http", old.HTTP, next.HTTP, func() { next.HTTP = old.HTTP })
+	keep("oidc.session", old.OIDC.Session, next.OIDC.Session, func() { next.OIDC.Session = old.OIDC.Session })
+	keep("metrics", old.Metrics, next.Metrics, func() { next.Metrics = old.Metrics })
+	keep("tracing", old.Tracing, next.Tracing, func() { next.Tracing = old.Tracing })
+	keep("audit", old.Audit, next.Audit, func() { next.Audit = old.Audit })
+	keep("authz.cel_policy_file", old.Authz.CELPolicyFile, next.Authz.CELPolicyFile, func() { next.Authz.CELPolicyFile = old.Authz.CELPolicyFile })
+
+	return changed
+}
+
+// Validate checks the consistency of the configuration. It does not access files or the network.
+func (c *Config) Validate() error {
+	switch c.OIDC.Verification {
+	case "", "introspect", "jwt":
+	default:
+		return fmt.Errorf("unknown oidc.verification mode %q", c.OIDC.Verification)
+	}
+
+	if (c.HTTP.TLS.Cert == "") != (c.HTTP.TLS.Key == "") {
+		return fmt.Errorf("http.tls.cert and http.tls.key must be set together")
+	}
+
+	// users of different issuers must never share an enrollment ID, and with it a Fabric identity
+	namespaces := make(map[string]bool)
+	for i, issuer := range c.OIDC.TrustedIssuers() {
+		if issuer.Namespace == "" {
+			// a mapped subject claim may hold values that equal enrollment IDs of other issuers
+			if i > 0 || issuer.Claims.Subject != "" {
+				return fmt.Errorf("oidc.issuers: issuer %s needs a namespace", issuer.Issuer)
+			}
+			continue
+		}
+		if err := checkNamespace(issuer.Namespace); err != nil {
+			return fmt.Errorf("oidc.issuers: issuer %s: %w", issuer.Issuer, err)
+		}
+		if namespaces[issuer.Namespace] {
+			return fmt.Errorf("oidc.issuers: namespace %s is used by more than one issuer", issuer.Namespace)
+		}
+		namespaces[issuer.Namespace] = true
+	}
+
+	if clientAuth := c.HTTP.TLS.ClientAuth; clientAuth.Enabled() {
+		// a certificate with CN=alice must never get the identity of OIDC user alice
+		if clientAuth.Namespace == "" {
+			return fmt.Errorf("http.tls.client_auth.namespace is required")
+		}
+		if err := checkNamespace(clientAuth.Namespace); err != nil {
+			return fmt.Errorf("http.tls.client_auth: %w", err)
+		}
+		if namespaces[clientAuth.Namespace] {
+			return fmt.Errorf("http.tls.client_auth.namespace %s is used by an OIDC issuer", clientAuth.Namespace)
+		}
+	}
+
+	for _, sa := range c.ServiceAccounts {
+		if sa.ClientID == "" {
+			return fmt.Errorf("every entry of service_accounts needs a client_id")
+		}
+		// any trusted issuer could otherwise mint tokens for the client ID
+		if sa.Issuer == "" && len(c.OIDC.TrustedIssuers()) > 1 {
+			return fmt.Errorf("service account %s needs an issuer, since several issuers are trusted", sa.ClientID)
+		}
+	}
+
+	names := make(map[string]bool)
+	homes := make(map[string]string)
+	for _, org := range c.Fabric.Organizations() {
+		if org.Name == "" {
+			return fmt.Errorf("every entry of fabric.orgs needs a name")
+		}
+		if names[org.Name] {
+			return fmt.Errorf("organization %s is configured more than once", org.Name)
+		}
+		names[org.Name] = true
+
+		if org.CA.URL == "" || org.GW.MSPID == "" {
+			return fmt.Errorf("organization %s: ca.url and gw.msp_id are required", org.Name)
+		}
+
+		// organizations sharing a client home would share the admin identity and users' identities
+		if org.CA.ClientHome == "" {
+			return fmt.Errorf("organization %s: ca.client_home is required", org.Name)
+		}
+		home := filepath.Clean(org.CA.ClientHome)
+		if other, ok := homes[home]; ok {
+			return fmt.Errorf("organizations %s and %s share ca.client_home %s", other, org.Name, org.CA.ClientHome)
+		}
+		homes[home] = org.Name
+	}
+
+	if r := c.Fabric.Retry; r.Attempts < 0 || r.Multiplier < 0 || r.Jitter < 0 || r.Jitter > 1 {
+		return fmt.Errorf("fabric.retry: attempts and multiplier must not be negative, jitter must be between 0 and 1")
+	}
+
+	for _, l := range []RateLimitConfig{c.RateLimits.Enroll, c.RateLimits.Evaluate, c.RateLimits.Submit} {
+		if l.RPS < 0 || l.Burst < 0 {
+			return fmt.Errorf("rate_limits: rps and burst must not be negative")
+		}
+	}
+	for _, g := range c.RateLimits.Groups {
+		if g.Group == "" {
+			return fmt.Errorf("every entry of rate_limits.groups needs a group")
+		}
+	}
+
+	return nil
+}
+
+// checkNamespace rejects namespaces that cannot be part of an enrollment ID, which is a path segment
+// of both the CA's REST API and the user's directory below the client home.
+func checkNamespace(namespace string) error {
+	if namespace == "." || strings.Contains(namespace, "..") || strings.ContainsAny(namespace, "@/\\?#% \t\r\n") {
+		return fmt.Errorf("invalid namespace %q: must not contain .., @, /, \\, ?, #, %% or whitespace", namespace)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+// Package doctor validates the configuration and checks connectivity to the OIDC issuers and the
+// Fabric network, reporting every problem found instead of failing on the first one.
+package doctor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/authz"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/zitadel/oidc/v3/pkg/client"
+	httphelper "github.com/zitadel/oidc/v3/pkg/http"
+	"go.uber.org/zap"
+)
+
+// Status of a check.
+const (
+	StatusPass = "PASS"
+	StatusWarn = "WARN"
+	StatusFail = "FAIL"
+	StatusSkip = "SKIP"
+)
+
+// expiryWarning is how long before expiry certificates are reported
+const expiryWarning = 30 * 24 * time.Hour
+
+// Result is the outcome of a single check.
+type Result struct {
+	Check  string
+	Status string
+	Detail string
+}
+
+// Report collects the results of all checks.
+type Report struct {
+	Results []Result
+}
+
+// Options select the checks to run.
+type Options struct {
+	Channels []string      // channels the admin identities must be able to query
+	Timeout  time.Duration // timeout of each network check
+}
+
+// Failed reports whether any check failed.
+func (r *Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the report, one line per check, followed by a summary.
+func (r *Report) Print(w io.Writer) {
+	counts := make(map[string]int)
+	for _, result := range r.Results {
+		counts[result.Status]++
+		if result.Detail == "" {
+			fmt.Fprintf(w, "[%s] %s\n", result.Status, result.Check)
+		} else {
+			fmt.Fprintf(w, "[%s] %s: %s\n", result.Status, result.Check, result.Detail)
+		}
+	}
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed, %d skipped\n",
+		counts[StatusPass], counts[StatusWarn], counts[StatusFail], counts[StatusSkip])
+}
+
+func (r *Report) add(check, status, detail string) {
+	r.Results = append(r.Results, Result{Check: check, Status: status, Detail: detail})
+}
+
+func (r *Report) check(check string, err error) bool {
+	if err != nil {
+		r.add(check, StatusFail, err.Error())
+		return false
+	}
+	r.add(check, StatusPass, "")
+	return true
+}
+
+// Run validates the configuration, then checks the OIDC issuers and every organization's CA,
+// admin enrollment, gateway peers and channel access.
+func Run(ctx context.Context, conf *config.Config, logger *zap.Logger, opts Options) *Report {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+
+	r := &Report{}
+	configOK := r.validate(conf, logger)
+
+	for _, issuer := range conf.OIDC.TrustedIssuers() {
+		checkCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		_, err := client.Discover(checkCtx, issuer.Issuer, httphelper.DefaultHTTPClient)
+		cancel()
+		r.check("OIDC discovery of "+issuer.Issuer, err)
+	}
+
+	if !configOK {
+		r.add("Fabric network", StatusSkip, "the configuration is invalid")
+		return r
+	}
+
+	if !r.check("Fabric client initialization", fabric.Init(config.NewHolder(conf, logger), logger)) {
+		return r
+	}
+
+	for _, org := range fabric.Orgs() {
+		prefix := "organization " + org.Name + ": "
+
+		caClient, err := fabric.NewCAClient(org.CA)
+		if r.check(prefix+"CA client", err) {
+			if info, err := caClient.CAInfo(); err != nil {
+				r.check(prefix+"CA info from "+org.CA.URL, err)
+			} else {
+				r.add(prefix+"CA info from "+org.CA.URL, StatusPass, "CA name "+info.CAName)
+			}
+		}
+
+		adminOK := r.check(prefix+"admin enrollment", org.EnrollAdmin())
+
+		peersOK := false
+		peerErrs := org.CheckPeers(ctx, opts.Timeout)
+		for _, peer := range org.GW.GatewayPeers() {
+			if r.check(prefix+"gateway peer "+peer.Endpoint, peerErrs[peer.Endpoint]) {
+				peersOK = true
+			}
+		}
+
+		for _, channel := range opts.Channels {
+			check := prefix + "access to channel " + channel
+			if !adminOK || !peersOK {
+				r.add(check, StatusSkip, "admin enrollment or gateway peers failed")
+				continue
+			}
+			checkCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+			r.check(check, org.CheckChannel(checkCtx, channel))
+			cancel()
+		}
+	}
+
+	return r
+}
+
+// validate checks required settings, policies and the certificate files of the configuration.
+func (r *Report) validate(conf *config.Config, logger *zap.Logger) bool {
+	ok := true
+	require := func(key, value string) {
+		if value == "" {
+			r.add(key, StatusFail, "is required")
+			ok = false
+		}
+	}
+
+	if !conf.HTTP.TLS.ClientAuth.Required {
+		require("oidc.issuer", conf.OIDC.Issuer)
+		require("oidc.client_id", conf.OIDC.ClientID)
+		if conf.OIDC.Verification == "" || conf.OIDC.Verification == "introspect" {
+			require("oidc.client_secret", conf.OIDC.ClientSecret)
+		}
+	}
+	if conf.OIDC.Session.RedirectURI != "" && len(conf.OIDC.Session.Secret) < 32 {
+		r.add("oidc.session.secret", StatusFail, "must be at least 32 characters long")
+		ok = false
+	}
+
+	if (conf.HTTP.TLS.Cert == "") != (conf.HTTP.TLS.Key == "") {
+		r.add("http.tls", StatusFail, "cert and key must be set together")
+		ok = false
+	} else if conf.HTTP.TLS.Cert != "" {
+		ok = r.keyPair("http.tls", conf.HTTP.TLS.Cert, conf.HTTP.TLS.Key) && ok
+	}
+	if conf.HTTP.TLS.ClientAuth.Enabled() {
+		ok = r.certFile("http.tls.client_auth.ca", conf.HTTP.TLS.ClientAuth.CA) && ok
+	}
+
+	for _, org := range conf.Fabric.Organizations() {
+		prefix := "organization " + org.Name + ": "
+		require(prefix+"ca.url", org.CA.URL)
+		require(prefix+"ca.client_home", org.CA.ClientHome)
+		require(prefix+"ca.admin", org.CA.Admin)
+		require(prefix+"ca.admin_secret", org.CA.AdminSecret)
+		require(prefix+"gw.msp_id", org.GW.MSPID)
+
+		if org.CA.TLSTrustedCerts != "" {
+			ok = r.certFile(prefix+"ca.tls_trusted_certs", org.CA.TLSTrustedCerts) && ok
+		}
+		if org.CA.TLSCert != "" || org.CA.TLSKey != "" {
+			ok = r.keyPair(prefix+"ca.tls_cert/tls_key", org.CA.TLSCert, org.CA.TLSKey) && ok
+		}
+		if org.GW.TLSCert != "" || org.GW.TLSKey != "" {
+			ok = r.keyPair(prefix+"gw.tls_cert/tls_key", org.GW.TLSCert, org.GW.TLSKey) && ok
+		}
+		for _, peer := range org.GW.GatewayPeers() {
+			require(prefix+"gateway peer endpoint", peer.Endpoint)
+			ok = r.certFile(prefix+"TLS roots of peer "+peer.Endpoint, peer.TLSTrustedCerts) && ok
+		}
+	}
+
+	if conf.Authz.PolicyFile != "" {
+		_, err := authz.LoadPolicy(conf.Authz.PolicyFile)
+		ok = r.check("authz.policy_file", err) && ok
+	}
+	if conf.Authz.CELPolicyFile != "" {
+		_, err := authz.NewEngine(conf.Authz.CELPolicyFile, logger)
+		ok = r.check("authz.cel_policy_file", err) && ok
+	}
+
+	return ok
+}
+
+// certFile checks that file holds at least one certificate and that none has expired.
+func (r *Report) certFile(check, file string) bool {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return r.check(check, err)
+	}
+
+	certs, err := parseCertificates(b)
+	if err == nil && len(certs) == 0 {
+		err = fmt.Errorf("no certificates found in %s", file)
+	}
+	if err != nil {
+		return r.check(check, err)
+	}
+
+	return r.expiry(check, file, certs)
+}
+
+// keyPair checks that the certificate and key match and that the certificate has not expired.
+func (r *Report) keyPair(check, certFile, keyFile string) bool {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return r.check(check, err)
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return r.check(check, err)
+	}
+
+	return r.expiry(check, certFile, []*x509.Certificate{leaf})
+}
+
+// expiry fails for expired certificates and warns about those expiring soon.
+func (r *Report) expiry(check, file string, certs []*x509.Certificate) bool {
+	now := time.Now()
+	for _, cert := range certs {
+		switch {
+		case now.After(cert.NotAfter):
+			r.add(check, StatusFail, fmt.Sprintf("%s: certificate %s expired on %s", file, cert.Subject, cert.NotAfter.Format(time.RFC3339)))
+			return false
+		case now.Before(cert.NotBefore):
+			r.add(check, StatusFail, fmt.Sprintf("%s: certificate %s is not valid before %s", file, cert.Subject, cert.NotBefore.Format(time.RFC3339)))
+			return false
+		case cert.NotAfter.Sub(now) < expiryWarning:
+			r.add(check, StatusWarn, fmt.Sprintf("%s: certificate %s expires on %s", file, cert.Subject, cert.NotAfter.Format(time.RFC3339)))
+			return true
+		}
+	}
+
+	r.add(check, StatusPass, file)
+	return true
+}
+
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+}
@@ -1,51 +1,64 @@
 package fabric
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/edgeflare/fabric-oidc-proxy/internal/audit"
 	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/metrics"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/tracing"
+	"github.com/edgeflare/pgo"
 	"github.com/hyperledger/fabric-ca/api"
 	"github.com/hyperledger/fabric-ca/lib"
 	"github.com/hyperledger/fabric-ca/lib/client/credential/x509"
 	"github.com/hyperledger/fabric-ca/lib/tls"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
 )
 
 // CAClient wraps the Fabric CA client with additional functionality.
 type CAClient struct {
 	caClient *lib.Client
+	conf     config.FabricCAConfig
 }
 
 // MSPKeyCert holds the certificate and key for a user's Membership Service Provider (MSP).
 type MSPKeyCert struct {
 	Cert string `json:"msp.crt"`
-	Key  string `json:"msp.key"`
+	Key  string `json:"msp.key,omitempty"`
 }
 
-// NewCAClient initializes and returns a new Fabric CA client using configuration from the config package
-func NewCAClient(cfg *config.Config, userHomeDir ...string) (*CAClient, error) {
+// NewCAClient initializes and returns a new Fabric CA client for the CA of an organization.
+// Without userHomeDir, the client uses the organization's client home holding the admin identity.
+func NewCAClient(ca config.FabricCAConfig, userHomeDir ...string) (*CAClient, error) {
 	var homeDir string
 
 	if len(userHomeDir) > 0 {
 		homeDir = userHomeDir[0]
 	} else {
-		homeDir = cfg.Fabric.CA.ClientHome
+		homeDir = ca.ClientHome
 	}
 
 	caClient := &lib.Client{
 		HomeDir: homeDir,
 		Config: &lib.ClientConfig{
-			URL:    cfg.Fabric.CA.URL,
-			MSPDir: cfg.Fabric.CA.ClientMSPDir,
+			URL:    ca.URL,
+			MSPDir: ca.ClientMSPDir,
 			TLS: tls.ClientTLSConfig{
 				Enabled: true,
 				CertFiles: []string{
-					cfg.Fabric.CA.TLSTrustedCerts,
+					ca.TLSTrustedCerts,
 				},
 				Client: tls.KeyCertFiles{
-					KeyFile:  cfg.Fabric.CA.TLSKey,
-					CertFile: cfg.Fabric.CA.TLSCert,
+					KeyFile:  ca.TLSKey,
+					CertFile: ca.TLSCert,
 				},
 			},
 		},
@@ -55,15 +68,17 @@ func NewCAClient(cfg *config.Config, userHomeDir ...string) (*CAClient, error) {
 		return nil, fmt.Errorf("failed to initialize CA client: %w", err)
 	}
 
-	return &CAClient{caClient: caClient}, nil
+	return &CAClient{caClient: caClient, conf: ca}, nil
 }
 
 // Enroll performs the enrollment process for a user or administrator.
 // It takes an api.EnrollmentRequest and returns the resulting lib.Identity or an error.
 func (c *CAClient) Enroll(request *api.EnrollmentRequest) (*lib.Identity, error) {
+	start := time.Now()
 	er, err := c.caClient.Enroll(request)
+	metrics.ObserveCA(c.conf.URL, "enroll", time.Since(start), err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to enroll: %w", err)
+		return nil, newCAError("enroll", err)
 	}
 
 	identity := er.Identity
@@ -89,28 +104,109 @@ func (c *CAClient) EnrollAdmin() (*lib.Identity, error) {
 	}
 
 	return c.Enroll(&api.EnrollmentRequest{
-		Name:    cfg.Fabric.CA.Admin,
-		Secret:  cfg.Fabric.CA.AdminSecret,
+		Name:    c.conf.Admin,
+		Secret:  c.conf.AdminSecret,
 		Profile: "tls",
 		Type:    "x509",
 	})
 }
 
-// RegisterAndEnrollUser registers and enrolls a new user using the provided admin identity.
-// It creates a user directory, initializes CA clients for the admin and the new user,
-// enrolls the admin, registers the new user, and then enrolls the new user.
-func RegisterAndEnrollUser(regReq api.RegistrationRequest) (*lib.Identity, error) {
-	userDir := filepath.Join(cfg.Fabric.CA.ClientHome, "users", regReq.Name)
-	if err := createUserDir(userDir); err != nil {
+// CAInfo returns the name and certificate chain of the CA, without authenticating.
+func (c *CAClient) CAInfo() (*lib.GetCAInfoResponse, error) {
+	start := time.Now()
+	info, err := c.caClient.GetCAInfo(&api.GetCAInfoRequest{})
+	metrics.ObserveCA(c.conf.URL, "cainfo", time.Since(start), err)
+	if err != nil {
+		return nil, newCAError("cainfo", err)
+	}
+	return info, nil
+}
+
+// Reenroll renews the certificate of the identity loaded from the client's home directory,
+// reusing its private key so that the key in the keystore stays valid.
+func (c *CAClient) Reenroll(profile string) (*lib.Identity, error) {
+	identity, err := c.caClient.LoadMyIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+
+	start := time.Now()
+	er, err := identity.Reenroll(&api.ReenrollmentRequest{
+		Profile: profile,
+		CSR:     &api.CSRInfo{KeyRequest: &api.KeyRequest{ReuseKey: true}},
+	})
+	metrics.ObserveCA(c.conf.URL, "reenroll", time.Since(start), err)
+	if err != nil {
+		return nil, newCAError("reenroll", err)
+	}
+
+	certFilePath := filepath.Join(er.Identity.GetClient().Config.MSPDir, "signcerts", "cert.pem")
+	if err := writeCert(er.Identity, certFilePath); err != nil {
+		return nil, fmt.Errorf("failed to save cert to file: %w", err)
+	}
+
+	return er.Identity, nil
+}
+
+// EnrollUser registers and enrolls a user with the CA of an organization, unless the user's MSP
+// artifacts exist already. Concurrent calls for a user, also by replicas sharing
+// fabric.ca.client_home, register and enroll the user once. An optional CA signing profile
+// overrides the default "tls" profile.
+func EnrollUser(ctx context.Context, org *Org, regReq api.RegistrationRequest, profile ...string) error {
+	userDir := org.UserHomeDir(regReq.Name)
+	if Enrolled(userDir) {
+		return nil
+	}
+
+	unlock, err := lockUser(ctx, userDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// another request may have enrolled the user while this one waited for the lock
+	if Enrolled(userDir) {
+		return nil
+	}
+
+	_, err = registerAndEnrollUser(ctx, org, regReq, profile...)
+	return err
+}
+
+// registerAndEnrollUser registers and enrolls a new user with the CA of an organization, while
+// holding the user's lock. It initializes CA clients for the admin and the new user, enrolls the
+// admin, registers the new user, and then enrolls the new user into a staging directory, which is
+// moved into place once the key and certificate are written, so that the MSP artifacts appear at
+// once. A user registered before, whose MSP artifacts were lost, is enrolled again after resetting
+// the enrollment secret.
+func registerAndEnrollUser(ctx context.Context, org *Org, regReq api.RegistrationRequest, profile ...string) (identity *lib.Identity, err error) {
+	_, span := tracing.Start(ctx, "fabric.RegisterAndEnrollUser", tracing.AttrOrg.String(org.Name),
+		attribute.String("fabric.enrollment_id", regReq.Name), attribute.String("fabric.identity_type", regReq.Type))
+	defer func() {
+		tracing.End(span, err)
+		metrics.CountEnrollment(org.Name, err)
+		auditEnrollment(ctx, org, regReq.Name, err)
+	}()
+
+	userDir := org.UserHomeDir(regReq.Name)
+	removeStagingDirs(userDir)
+
+	stagingDir, err := os.MkdirTemp(userDir, stagingDirPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	if err := createUserDir(stagingDir); err != nil {
 		return nil, fmt.Errorf("failed to create user directory: %w", err)
 	}
 
-	userCAClient, err := NewCAClient(&cfg, userDir)
+	userCAClient, err := NewCAClient(org.CA, stagingDir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize user CA client: %w", err)
 	}
 
-	adminCAClient, err := NewCAClient(&cfg)
+	adminCAClient, err := NewCAClient(org.CA)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize admin CA client: %w", err)
 	}
@@ -120,17 +216,153 @@ func RegisterAndEnrollUser(regReq api.RegistrationRequest) (*lib.Identity, error
 		return nil, fmt.Errorf("failed to enroll admin: %w", err)
 	}
 
+	start := time.Now()
 	rr, err := adminIdentity.Register(&regReq)
+	metrics.ObserveCA(org.CA.URL, "register", time.Since(start), err)
+	recovered := false
 	if err != nil {
-		return nil, fmt.Errorf("failed to register user: %v", err)
+		caErr := newCAError("register", err)
+		if !caErr.AlreadyRegistered() {
+			return nil, caErr
+		}
+
+		// registered before, but the MSP artifacts are gone, e.g. with a lost volume
+		rr = &api.RegistrationResponse{}
+		if rr.Secret, err = resetSecret(org, adminIdentity, regReq, caErr); err != nil {
+			return nil, err
+		}
+		recovered = true
 	}
 
-	return userCAClient.Enroll(&api.EnrollmentRequest{
+	enrollProfile := "tls"
+	if len(profile) > 0 && profile[0] != "" {
+		enrollProfile = profile[0]
+	}
+
+	identity, err = userCAClient.Enroll(&api.EnrollmentRequest{
 		Name:    regReq.Name,
 		Secret:  rr.Secret,
-		Profile: "tls",
+		Profile: enrollProfile,
 		Type:    "x509",
 	})
+	if err != nil {
+		if recovered {
+			// e.g. revoked, or its enrollments are capped by the CA's max enrollments
+			return nil, newRecoveryError("enrollment with the reset secret failed", err)
+		}
+		return nil, err
+	}
+
+	if err := installMSP(stagingDir, userDir); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+// resetSecret recovers an identity registered before whose MSP artifacts are missing. It resets the
+// enrollment secret to a random one and applies fabric.ca.recovery_max_enrollments, so that the
+// identity can be enrolled again. Identities the registration request could not have
+// registered, by type, affiliation or attributes, are not recovered, so that a user never takes over
+// an identity registered for someone else, e.g. a registrar.
+func resetSecret(org *Org, adminIdentity *lib.Identity, regReq api.RegistrationRequest, regErr *CAError) (string, error) {
+	start := time.Now()
+	existing, err := adminIdentity.GetIdentity(regReq.Name, "")
+	metrics.ObserveCA(org.CA.URL, "get_identity", time.Since(start), err)
+	if err != nil {
+		return "", newCAError("get_identity", err)
+	}
+
+	if reason := recoveryConflict(org, existing, regReq); reason != "" {
+		logger.Warn("Not recovering registered identity", zap.String("org", org.Name),
+			zap.String("enrollment_id", regReq.Name), zap.String("reason", reason))
+		return "", newRecoveryError(reason, regErr)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate enrollment secret: %w", err)
+	}
+	secret := hex.EncodeToString(b)
+
+	start = time.Now()
+	_, err = adminIdentity.ModifyIdentity(&api.ModifyIdentityRequest{
+		ID:             regReq.Name,
+		Secret:         secret,
+		MaxEnrollments: recoveryMaxEnrollments(org.CA, existing),
+	})
+	metrics.ObserveCA(org.CA.URL, "modify_identity", time.Since(start), err)
+	if err != nil {
+		return "", newCAError("modify_identity", err)
+	}
+
+	logger.Info("Reset enrollment secret of registered identity with missing MSP", zap.String("org", org.Name), zap.String("enrollment_id", regReq.Name))
+	return secret, nil
+}
+
+// recoveryMaxEnrollments returns the max enrollments of a recovered identity. The CA counts the
+// enrollments of an identity and ModifyIdentity does not reset the count, so unless configured
+// otherwise the identity's limit is raised by one. 0 leaves the limit unchanged, e.g. an unlimited one.
+func recoveryMaxEnrollments(conf config.FabricCAConfig, existing *api.GetIDResponse) int {
+	if conf.RecoveryMaxEnrollments != 0 {
+		return conf.RecoveryMaxEnrollments
+	}
+	if existing.MaxEnrollments > 0 {
+		return existing.MaxEnrollments + 1
+	}
+	return 0
+}
+
+// recoveryConflict returns why an existing identity may not be recovered for a registration
+// request, or an empty string. Unset types and affiliations default to those of the registrar, so
+// they only rule out node identities.
+func recoveryConflict(org *Org, existing *api.GetIDResponse, regReq api.RegistrationRequest) string {
+	if regReq.Name == org.CA.Admin {
+		return "it is the registrar"
+	}
+
+	switch {
+	case regReq.Type != "" && existing.Type != regReq.Type:
+		return fmt.Sprintf("it is registered with type %s", existing.Type)
+	case regReq.Type == "" && (existing.Type == "peer" || existing.Type == "orderer"):
+		return fmt.Sprintf("it is registered with type %s", existing.Type)
+	}
+
+	affiliation := regReq.Affiliation
+	if affiliation == "." {
+		affiliation = ""
+	}
+	if regReq.Affiliation != "" && existing.Affiliation != affiliation {
+		return fmt.Sprintf("it is registered with affiliation %q", existing.Affiliation)
+	}
+
+	requested := make(map[string]string)
+	for _, a := range regReq.Attributes {
+		requested[a.Name] = a.Value
+	}
+	for _, a := range existing.Attributes {
+		switch a.Name {
+		case "hf.EnrollmentID", "hf.Type", "hf.Affiliation":
+			continue // added to every identity by the CA
+		}
+		if v, ok := requested[a.Name]; !ok || v != a.Value {
+			return fmt.Sprintf("it holds attribute %s, which was not requested", a.Name)
+		}
+	}
+
+	return ""
+}
+
+// auditEnrollment records an enrollment in the audit log, attributed to the user in the context.
+func auditEnrollment(ctx context.Context, org *Org, enrollmentID string, enrollErr error) {
+	rec := audit.Record{Action: audit.ActionEnroll, Org: org.Name, EnrollmentID: enrollmentID}
+	if user, ok := ctx.Value(pgo.OIDCUserCtxKey).(*oidc.IntrospectionResponse); ok && user != nil {
+		rec.Issuer, rec.Subject = user.Issuer, user.Subject
+	}
+
+	if err := audit.Write(rec, enrollErr); err != nil {
+		logger.Error("Failed to write audit record", zap.String("action", rec.Action), zap.String("enrollment_id", enrollmentID), zap.Error(err))
+	}
 }
 
 // certFromIdentity retrieves the certificate string from the given identity.
@@ -148,30 +380,34 @@ func certFromIdentity(identity *lib.Identity) (string, error) {
 	return string(signer.Cert()), nil
 }
 
-// writeCert writes the certificate string extracted from the given identity to the specified file path.
+// writeCert writes the certificate string extracted from the given identity to the specified file
+// path. The certificate is written to a temporary file first and then renamed, so that readers
+// never see a partially written certificate.
 func writeCert(identity *lib.Identity, filePath string) error {
 	certString, err := certFromIdentity(identity)
 	if err != nil {
 		return fmt.Errorf("failed to get certificate from identity: %w", err)
 	}
 
-	file, err := os.Create(filePath)
+	file, err := os.CreateTemp(filepath.Dir(filePath), ".cert-*.pem")
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
-
-	// Close the file and check for an error
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			err = fmt.Errorf("failed to close file: %w", cerr)
-		}
-	}()
+	defer os.Remove(file.Name())
 
 	if _, err := file.WriteString(certString); err != nil {
+		file.Close()
 		return fmt.Errorf("failed to write to file: %w", err)
 	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
 
-	return err
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to replace certificate file: %w", err)
+	}
+
+	return nil
 }
 
 // createUserDir creates a user directory with the necessary structure for storing MSP artifacts.
@@ -184,6 +420,43 @@ func createUserDir(userDir string) error {
 	return nil
 }
 
+// stagingDirPrefix prefixes the directories users are enrolled into before their MSP is installed
+const stagingDirPrefix = ".enroll-"
+
+// installMSP moves the MSP directory enrolled into stagingDir into userDir, replacing what an
+// interrupted enrollment may have left there. The caller must hold the user's lock.
+func installMSP(stagingDir, userDir string) error {
+	mspDir := filepath.Join(userDir, "msp")
+	if err := os.RemoveAll(mspDir); err != nil {
+		return fmt.Errorf("failed to remove incomplete MSP directory: %w", err)
+	}
+
+	if err := os.Rename(filepath.Join(stagingDir, "msp"), mspDir); err != nil {
+		return fmt.Errorf("failed to install MSP directory: %w", err)
+	}
+
+	return nil
+}
+
+// removeStagingDirs removes the staging directories of interrupted enrollments of a user. The
+// caller must hold the user's lock.
+func removeStagingDirs(userDir string) {
+	dirs, _ := filepath.Glob(filepath.Join(userDir, stagingDirPrefix+"*"))
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// Enrolled reports whether both the private key and the certificate of an identity are stored
+// in homeDir.
+func Enrolled(homeDir string) bool {
+	if _, err := GetMSPKeyfile(homeDir); err != nil {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(homeDir, "msp", "signcerts", "cert.pem"))
+	return err == nil
+}
+
 // GetMSPKeyfile finds the first key file in the keystore directory within the specified home directory.
 func GetMSPKeyfile(homeDir string) (string, error) {
 	keystoreDir := filepath.Join(homeDir, "msp", "keystore")
@@ -0,0 +1,207 @@
+package fabric
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Phases of a transaction a TxError can occur in.
+const (
+	TxPhaseEndorse      = "endorse"
+	TxPhaseSubmit       = "submit"
+	TxPhaseCommitStatus = "commit_status"
+	TxPhaseCommit       = "commit"
+	TxPhaseEvaluate     = "evaluate"
+)
+
+// TxError is a failed transaction, classified by the phase it failed in. Gateway errors carry the
+// gRPC status and the errors of the individual peers; transactions failing validation carry the
+// validation code.
+type TxError struct {
+	Phase          string
+	TxID           string
+	Code           codes.Code // gRPC status code, OK for transactions failing validation
+	Message        string
+	ValidationCode string // e.g. MVCC_READ_CONFLICT, for transactions failing validation
+	Peers          []PeerError
+	Attempts       int // number of times the transaction was submitted, if retried
+	err            error
+}
+
+// PeerError is the error reported by a single peer or orderer, e.g. for an endorsement.
+type PeerError struct {
+	Address          string `json:"address"`
+	MSPID            string `json:"msp_id"`
+	Message          string `json:"message"`
+	ChaincodeStatus  int32  `json:"chaincode_status,omitempty"`
+	ChaincodeMessage string `json:"chaincode_message,omitempty"`
+}
+
+func (e *TxError) Error() string {
+	if e.TxID != "" {
+		return fmt.Sprintf("%s of transaction %s failed: %s", e.Phase, e.TxID, e.Message)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Phase, e.Message)
+}
+
+func (e *TxError) Unwrap() error {
+	return e.err
+}
+
+// ChaincodeMessage returns the error message the chaincode responded with, if any.
+func (e *TxError) ChaincodeMessage() string {
+	for _, p := range e.Peers {
+		if p.ChaincodeMessage != "" {
+			return p.ChaincodeMessage
+		}
+	}
+	return ""
+}
+
+// OutcomeUnknown reports whether the transaction may have been committed despite the error: its
+// commit status could not be obtained, or submitting it to the orderer failed without the orderer
+// rejecting it, e.g. with a timeout, so that it may have been ordered.
+func (e *TxError) OutcomeUnknown() bool {
+	switch e.Phase {
+	case TxPhaseCommitStatus:
+		return true
+	case TxPhaseSubmit:
+		switch e.Code {
+		case codes.InvalidArgument, codes.FailedPrecondition, codes.NotFound, codes.PermissionDenied,
+			codes.Unauthenticated, codes.Aborted:
+			return false // rejected before ordering
+		}
+		return true
+	}
+	return false
+}
+
+// Uncommitted reports whether a transaction that failed with err certainly did not update the
+// ledger: it failed endorsement, was rejected by the orderer, or was ordered but invalidated. If
+// the outcome is unknown, the transaction may have been committed.
+func Uncommitted(err error) bool {
+	var txErr *TxError
+	if !errors.As(err, &txErr) {
+		return true // failed before a proposal was endorsed
+	}
+	return !txErr.OutcomeUnknown()
+}
+
+// chaincodeResponse matches the messages peers report for chaincode responses with an error status
+var chaincodeResponse = regexp.MustCompile(`(?s)^chaincode response (\d+), (.*)$`)
+
+// newTxError classifies an error of the fabric-gateway client. The phase is taken from the error
+// type if it tells, otherwise phase is used.
+func newTxError(phase, txID string, err error) *TxError {
+	var commitErr *client.CommitError
+	if errors.As(err, &commitErr) {
+		return newCommitError(commitErr.TransactionID, commitErr.Code, err)
+	}
+
+	var (
+		endorseErr      *client.EndorseError
+		submitErr       *client.SubmitError
+		commitStatusErr *client.CommitStatusError
+	)
+	switch {
+	case errors.As(err, &endorseErr):
+		phase, txID = TxPhaseEndorse, endorseErr.TransactionID
+	case errors.As(err, &submitErr):
+		phase, txID = TxPhaseSubmit, submitErr.TransactionID
+	case errors.As(err, &commitStatusErr):
+		phase, txID = TxPhaseCommitStatus, commitStatusErr.TransactionID
+	}
+
+	st := grpcStatus(err)
+	txErr := &TxError{Phase: phase, TxID: txID, Code: st.Code(), Message: st.Message(), err: err}
+	for _, d := range st.Details() {
+		detail, ok := d.(*gateway.ErrorDetail)
+		if !ok {
+			continue
+		}
+		peerErr := PeerError{Address: detail.GetAddress(), MSPID: detail.GetMspId(), Message: detail.GetMessage()}
+		if m := chaincodeResponse.FindStringSubmatch(detail.GetMessage()); m != nil {
+			code, _ := strconv.ParseInt(m[1], 10, 32)
+			peerErr.ChaincodeStatus, peerErr.ChaincodeMessage = int32(code), m[2]
+		}
+		txErr.Peers = append(txErr.Peers, peerErr)
+	}
+
+	return txErr
+}
+
+// grpcStatus returns the gRPC status wrapped by err, keeping its message rather than that of err.
+func grpcStatus(err error) *status.Status {
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus()
+	}
+	return status.Convert(err)
+}
+
+// newCommitError returns the error of a transaction that failed validation.
+func newCommitError(txID string, code peer.TxValidationCode, err error) *TxError {
+	return &TxError{
+		Phase:          TxPhaseCommit,
+		TxID:           txID,
+		Code:           codes.OK,
+		Message:        fmt.Sprintf("transaction failed to commit with status code %d (%s)", int32(code), code),
+		ValidationCode: code.String(),
+		err:            err,
+	}
+}
+
+// ErrNotRecoverable is wrapped by the CAError of an identity registered before whose MSP artifacts
+// are missing, when it cannot be enrolled again.
+var ErrNotRecoverable = errors.New("registered identity cannot be recovered")
+
+// CAError is a failed request to a Fabric CA. Code is the error code of the CA server, e.g.
+// caerrors.ErrDupIdentityReg, or 0 if the CA did not respond with one.
+type CAError struct {
+	Op      string // enroll, reenroll, register, cainfo or recover
+	Code    int
+	Message string
+	err     error
+}
+
+func (e *CAError) Error() string {
+	return fmt.Sprintf("failed to %s: %v", e.Op, e.err)
+}
+
+func (e *CAError) Unwrap() error {
+	return e.err
+}
+
+// AlreadyRegistered reports whether the CA rejected a registration because the identity exists.
+func (e *CAError) AlreadyRegistered() bool {
+	return e.Code == caerrors.ErrDupIdentityReg
+}
+
+// newRecoveryError returns the CAError of an identity that cannot be recovered, for reason.
+func newRecoveryError(reason string, err error) *CAError {
+	caErr := newCAError("recover", err)
+	caErr.err = fmt.Errorf("%w: %s: %w", ErrNotRecoverable, reason, err)
+	return caErr
+}
+
+// caServerError matches the errors the fabric-ca client returns for error responses of the server
+var caServerError = regexp.MustCompile(`Error Code: (\d+) - ([^\n]*)`)
+
+// newCAError classifies an error of the fabric-ca client.
+func newCAError(op string, err error) *CAError {
+	caErr := &CAError{Op: op, Message: err.Error(), err: err}
+	if m := caServerError.FindStringSubmatch(err.Error()); m != nil {
+		caErr.Code, _ = strconv.Atoi(m[1])
+		caErr.Message = m[2]
+	}
+	return caErr
+}
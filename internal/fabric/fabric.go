@@ -1,16 +1,42 @@
 package fabric
 
 import (
+	"fmt"
+
 	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/metrics"
 	"go.uber.org/zap"
 )
 
 var (
-	cfg config.Config
+	conf            *config.Holder
+	logger          *zap.Logger
+	fabricCollector = newCollector()
 )
 
-// Init initializes client config to interact with the Fabric network
-func Init(conf *config.Config, lgr *zap.Logger) error {
-	cfg = *conf
+// Init initializes client config to interact with the Fabric network. Organizations are replaced
+// whenever the configuration is reloaded.
+func Init(holder *config.Holder, lgr *zap.Logger) error {
+	conf = holder
+	logger = lgr
+
+	o, err := newOrgs(cfg().Fabric)
+	if err != nil {
+		return err
+	}
+	o.start()
+	orgs.Store(o)
+
+	conf.OnReload(reloadOrgs)
+
+	if err := metrics.Register(fabricCollector); err != nil {
+		return fmt.Errorf("failed to register metrics: %w", err)
+	}
+
 	return nil
 }
+
+// cfg returns the current configuration.
+func cfg() *config.Config {
+	return conf.Load()
+}
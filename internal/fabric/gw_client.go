@@ -4,50 +4,68 @@ import (
 	"context"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/metrics"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/tracing"
 	"github.com/edgeflare/pgo"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/hyperledger/fabric-gateway/pkg/identity"
 	"github.com/zitadel/oidc/v3/pkg/oidc"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Timeouts of gateway calls. Calls given a context apply them to it, since the client only applies
+// its configured timeouts to calls without one.
+const (
+	evaluateTimeout     = 5 * time.Second
+	endorseTimeout      = 15 * time.Second
+	submitTimeout       = 5 * time.Second
+	commitStatusTimeout = 1 * time.Minute
 )
 
 // GWClient wraps the Fabric Gateway client.
 type GWClient struct {
 	*client.Gateway
+	peer *gatewayPeer
 }
 
-// NewGatewayClient creates a new Fabric Gateway client.
-// It establishes a gRPC connection to the Fabric peer, creates user identity and signing objects,
+// NewGatewayClient creates a new Fabric Gateway client for an organization.
+// It picks one of the organization's gateway peers, creates user identity and signing objects,
 // and returns a GWClient instance for interacting with the Fabric network.
-func NewGatewayClient(ctx context.Context, conf ...config.Config) (*GWClient, error) {
-	// Create a copy of the global configuration to avoid modifying it directly
-	localCfg := cfg
+func NewGatewayClient(ctx context.Context, org *Org, conf ...config.Config) (*GWClient, error) {
+	peer, err := org.peers.pick(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGatewayClient(org, peer, conf...)
+}
+
+// newGatewayClient creates a Fabric Gateway client connected to the given peer.
+func newGatewayClient(org *Org, peer *gatewayPeer, conf ...config.Config) (*GWClient, error) {
+	// Create a copy of the organization's configuration to avoid modifying it directly
+	gwConf := org.GW
 
 	// If a configuration is provided, override MSPCert and MSPKey
 	if len(conf) > 0 {
-		localCfg.Fabric.GW.MSPCert = conf[0].Fabric.GW.MSPCert
-		localCfg.Fabric.GW.MSPKey = conf[0].Fabric.GW.MSPKey
-	}
-
-	// Load configuration from the local copy
-	clientConn, err := newGrpcConnection(ctx) // Pass the context to newGrpcConnection if needed
-	if err != nil {
-		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
+		gwConf.MSPCert = conf[0].Fabric.GW.MSPCert
+		gwConf.MSPKey = conf[0].Fabric.GW.MSPKey
 	}
 
-	id, err := newIdentity(localCfg.Fabric.GW.MSPCert, localCfg.Fabric.GW.MSPID)
+	id, err := newIdentity(gwConf.MSPCert, gwConf.MSPID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create identity: %w", err)
 	}
 
-	sign, err := newSign(localCfg.Fabric.GW.MSPKey)
+	sign, err := newSign(gwConf.MSPKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create signer: %w", err)
 	}
@@ -55,11 +73,11 @@ func NewGatewayClient(ctx context.Context, conf ...config.Config) (*GWClient, er
 	gateway, err := client.Connect(
 		id,
 		client.WithSign(sign),
-		client.WithClientConnection(clientConn),
-		client.WithEvaluateTimeout(5*time.Second),
-		client.WithEndorseTimeout(15*time.Second),
-		client.WithSubmitTimeout(5*time.Second),
-		client.WithCommitStatusTimeout(1*time.Minute),
+		client.WithClientConnection(peer.conn),
+		client.WithEvaluateTimeout(evaluateTimeout),
+		client.WithEndorseTimeout(endorseTimeout),
+		client.WithSubmitTimeout(submitTimeout),
+		client.WithCommitStatusTimeout(commitStatusTimeout),
 	)
 
 	if err != nil {
@@ -68,80 +86,227 @@ func NewGatewayClient(ctx context.Context, conf ...config.Config) (*GWClient, er
 
 	return &GWClient{
 		Gateway: gateway,
+		peer:    peer,
 	}, nil
 }
 
-// newGrpcConnection creates a new gRPC connection to the Fabric peer.
-// It loads the TLS certificate, configures transport credentials, and establishes the connection.
-func newGrpcConnection(ctx context.Context) (*grpc.ClientConn, error) {
-	_ = ctx
-	certificatePEM, err := os.ReadFile(cfg.Fabric.GW.TLSTrustedCerts)
+// TxResult is the outcome of a transaction.
+type TxResult struct {
+	Payload  []byte // result returned by the chaincode function
+	TxID     string // ID of a submitted transaction, of the last attempt if retried
+	Attempts int    // number of times a transaction was submitted
+}
+
+// SubmitTransaction submits a transaction to the Fabric network.
+// It retrieves user information from the context, creates a gateway client using the user's credentials,
+// and submits the transaction to the specified channel and chaincode. Once the proposal is created,
+// the result holds the transaction ID even if submitting fails.
+//
+// Transactions failing with a read conflict or a transient error are submitted again as configured
+// by fabric.retry, unless the context is WithoutRetry. The result holds the number of attempts.
+func SubmitTransaction(ctx context.Context, channelID, chaincodeID, fn string, args ...string) (result *TxResult, err error) {
+	ctx, span := tracing.Start(ctx, "fabric.SubmitTransaction", tracing.AttrChannel.String(channelID),
+		tracing.AttrChaincode.String(chaincodeID), tracing.AttrFunction.String(fn))
+	defer func() { tracing.End(span, err) }()
+
+	org, userCfg, err := userGatewayConfig(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read TLS certificate file: %w", err)
+		return nil, err
 	}
 
-	certificate, err := identity.CertificateFromPEM(certificatePEM)
+	retryConf := cfg().Fabric.Retry
+	attempts := maxAttempts(ctx, retryConf)
+	for attempt := 1; ; attempt++ {
+		result, err = submit(ctx, org, userCfg, channelID, chaincodeID, fn, args...)
+		if result != nil {
+			result.Attempts = attempt
+		}
+		var txErr *TxError
+		if errors.As(err, &txErr) {
+			txErr.Attempts = attempt
+		}
+
+		reason := retryReason(err)
+		if reason == "" || attempt >= attempts {
+			return result, err
+		}
+
+		delay := backoff(retryConf, attempt+1)
+		metrics.CountRetry(channelID, chaincodeID, reason)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("fabric.attempt", attempt+1), attribute.String("fabric.retry_reason", reason)))
+		logger.Debug("Retrying transaction", zap.String("tx_id", result.TxID), zap.String("reason", reason),
+			zap.Int("attempt", attempt+1), zap.Duration("backoff", delay))
+
+		select {
+		case <-ctx.Done():
+			return result, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// submit makes a single attempt to endorse, submit and commit a transaction.
+func submit(ctx context.Context, org *Org, userCfg config.Config, channelID, chaincodeID, fn string, args ...string) (*TxResult, error) {
+	gw, err := NewGatewayClient(ctx, org, userCfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse TLS certificate: %w", err)
+		return nil, fmt.Errorf("failed to create gateway client: %w", err)
 	}
+	defer gw.Close()
 
-	certPool := x509.NewCertPool()
-	certPool.AddCert(certificate)
-	transportCredentials := credentials.NewClientTLSFromCert(certPool, cfg.Fabric.GW.PeerServerNameOverride)
+	network := gw.GetNetwork(channelID)
+	contract := network.GetContract(chaincodeID)
 
-	connection, err := grpc.NewClient(cfg.Fabric.GW.PeerEndpoint,
-		grpc.WithTransportCredentials(transportCredentials),
-	)
+	proposal, err := contract.NewProposal(fn, client.WithArguments(args...))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
+		return nil, fmt.Errorf("failed to create proposal: %w", err)
 	}
 
-	return connection, nil
-}
+	result := &TxResult{TxID: proposal.TransactionID()}
 
-// SubmitTransaction submits a transaction to the Fabric network.
-// It retrieves user information from the context, creates a gateway client using the user's credentials,
-// and submits the transaction to the specified channel and chaincode.
-func SubmitTransaction(ctx context.Context, channelID, chaincodeID, fn string, args ...string) ([]byte, error) {
-	user, ok := ctx.Value(pgo.OIDCUserCtxKey).(*oidc.IntrospectionResponse)
-	if !ok || user == nil {
-		return nil, fmt.Errorf("no user found")
+	// the transaction may still commit once endorsed, so a client going away must not cancel it
+	ctx = context.WithoutCancel(ctx)
+	txID := tracing.AttrTxID.String(proposal.TransactionID())
+	trace.SpanFromContext(ctx).SetAttributes(txID)
+
+	start := time.Now()
+	spanCtx, span := tracing.Start(ctx, "fabric.endorse", txID)
+	callCtx, cancel := context.WithTimeout(spanCtx, endorseTimeout)
+	transaction, err := proposal.EndorseWithContext(callCtx)
+	cancel()
+	tracing.End(span, err)
+	metrics.ObserveTx(metrics.PhaseEndorse, channelID, chaincodeID, time.Since(start))
+	if err != nil {
+		return result, newTxError(TxPhaseEndorse, result.TxID, err)
 	}
 
-	userDir := filepath.Join(cfg.Fabric.CA.ClientHome, "users", user.Subject)
+	start = time.Now()
+	spanCtx, span = tracing.Start(ctx, "fabric.submit", txID)
+	callCtx, cancel = context.WithTimeout(spanCtx, submitTimeout)
+	commit, err := transaction.SubmitWithContext(callCtx)
+	cancel()
+	tracing.End(span, err)
+	metrics.ObserveTx(metrics.PhaseSubmit, channelID, chaincodeID, time.Since(start))
+	if err != nil {
+		return result, newTxError(TxPhaseSubmit, result.TxID, err)
+	}
 
-	keyPath, err := GetMSPKeyfile(userDir)
+	start = time.Now()
+	spanCtx, span = tracing.Start(ctx, "fabric.commit_status", txID)
+	callCtx, cancel = context.WithTimeout(spanCtx, commitStatusTimeout)
+	status, err := commit.StatusWithContext(callCtx)
+	cancel()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get MSP keyfile: %w", err)
+		err = newTxError(TxPhaseCommitStatus, result.TxID, err)
+	} else {
+		span.SetAttributes(attribute.String("fabric.validation_code", status.Code.String()), attribute.Int64("fabric.block_number", int64(status.BlockNumber)))
+		if !status.Successful {
+			err = newCommitError(status.TransactionID, status.Code, nil)
+		}
+	}
+	tracing.End(span, err)
+	metrics.ObserveTx(metrics.PhaseCommit, channelID, chaincodeID, time.Since(start))
+	if status != nil {
+		metrics.CountValidationCode(channelID, chaincodeID, status.Code.String())
+	}
+	if err != nil {
+		return result, err
 	}
 
-	certPath := filepath.Join(cfg.Fabric.CA.ClientHome, "users", user.Subject, "msp", "signcerts", "cert.pem")
+	result.Payload = transaction.Result()
+	return result, nil
+}
 
-	cfg := config.Config{
-		Fabric: config.FabricConfig{
-			GW: config.FabricGWConfig{
-				MSPCert: certPath,
-				MSPKey:  keyPath,
-			},
-		},
+// EvaluateTransaction evaluates a transaction, i.e. queries the ledger without updating it.
+// Evaluation is idempotent, so if a peer is unreachable it is retried on the other peers.
+func EvaluateTransaction(ctx context.Context, channelID, chaincodeID, fn string, args ...string) (result *TxResult, err error) {
+	ctx, span := tracing.Start(ctx, "fabric.EvaluateTransaction", tracing.AttrChannel.String(channelID),
+		tracing.AttrChaincode.String(chaincodeID), tracing.AttrFunction.String(fn))
+	defer func() { tracing.End(span, err) }()
+
+	org, userCfg, err := userGatewayConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tried := make(map[*gatewayPeer]bool)
+	var lastErr error
+	for {
+		peer, err := org.peers.pick(tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, newTxError(TxPhaseEvaluate, "", lastErr)
+			}
+			return nil, fmt.Errorf("failed to evaluate transaction on any gateway peer: %w", err)
+		}
+		tried[peer] = true
+
+		resultBytes, err := evaluateOn(ctx, org, peer, userCfg, channelID, chaincodeID, fn, args...)
+		if err == nil {
+			return &TxResult{Payload: resultBytes}, nil
+		}
+		if !retryable(err) {
+			return nil, newTxError(TxPhaseEvaluate, "", err)
+		}
+		lastErr = err
+
+		peer.unhealthy.Store(true)
+		logger.Warn("Gateway peer failed, evaluating on another peer", zap.String("peer", peer.endpoint), zap.Error(err))
 	}
+}
 
-	gw, err := NewGatewayClient(ctx, cfg)
+func evaluateOn(ctx context.Context, org *Org, peer *gatewayPeer, userCfg config.Config, channelID, chaincodeID, fn string, args ...string) ([]byte, error) {
+	gw, err := newGatewayClient(org, peer, userCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gateway client: %w", err)
 	}
+	defer gw.Close()
 
-	network := gw.GetNetwork(channelID)
-	contract := network.GetContract(chaincodeID)
+	ctx, cancel := context.WithTimeout(ctx, evaluateTimeout)
+	defer cancel()
 
-	resultBytes, err := contract.SubmitTransaction(fn, args...)
+	start := time.Now()
+	resultBytes, err := gw.GetNetwork(channelID).GetContract(chaincodeID).EvaluateWithContext(ctx, fn, client.WithArguments(args...))
 	if err != nil {
-		return nil, fmt.Errorf("failed to submit transaction: %w", err)
+		return nil, fmt.Errorf("failed to evaluate transaction: %w", err)
 	}
+	peer.observe(time.Since(start))
+	metrics.ObserveTx(metrics.PhaseEvaluate, channelID, chaincodeID, time.Since(start))
 
 	return resultBytes, nil
 }
 
+// userGatewayConfig returns the organization of the user in the context, and the gateway
+// configuration signing with the user's MSP.
+func userGatewayConfig(ctx context.Context) (*Org, config.Config, error) {
+	user, ok := ctx.Value(pgo.OIDCUserCtxKey).(*oidc.IntrospectionResponse)
+	if !ok || user == nil {
+		return nil, config.Config{}, fmt.Errorf("no user found")
+	}
+
+	org, err := OrgFor(user)
+	if err != nil {
+		return nil, config.Config{}, err
+	}
+
+	userDir := org.UserHomeDir(EnrollmentID(user))
+
+	keyPath, err := GetMSPKeyfile(userDir)
+	if err != nil {
+		return nil, config.Config{}, fmt.Errorf("failed to get MSP keyfile: %w", err)
+	}
+
+	certPath := filepath.Join(userDir, "msp", "signcerts", "cert.pem")
+
+	return org, config.Config{
+		Fabric: config.FabricConfig{
+			GW: config.FabricGWConfig{
+				MSPCert: certPath,
+				MSPKey:  keyPath,
+			},
+		},
+	}, nil
+}
+
 // newIdentity creates a new X509 identity for the user.
 // It loads the user's certificate and creates an identity object.
 func newIdentity(certPath, mspID string) (*identity.X509Identity, error) {
@@ -0,0 +1,16 @@
+package fabric
+
+import (
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// EnrollmentID returns the Fabric CA enrollment ID of an OIDC user. Users of an issuer with a
+// namespace are registered as <subject>@<namespace>, so that equal subjects issued by different
+// IdPs never share a Fabric identity.
+func EnrollmentID(user *oidc.IntrospectionResponse) string {
+	issuer, _ := cfg().TrustedIssuer(user.Issuer)
+	if issuer.Namespace == "" {
+		return user.Subject
+	}
+	return user.Subject + "@" + issuer.Namespace
+}
@@ -0,0 +1,143 @@
+package fabric
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// userLockFile is the lock file in a user's directory, shared by replicas sharing the client home
+	userLockFile = ".lock"
+	// userLockLease is after which a lock file is considered abandoned by a crashed replica
+	userLockLease = 2 * time.Minute
+	// userLockPoll is how often a replica waiting for a lock file checks whether it was released
+	userLockPoll = 100 * time.Millisecond
+)
+
+// userLocks holds the in-process locks of user directories, by directory
+var (
+	userLocksMu sync.Mutex
+	userLocks   = make(map[string]*userLock)
+)
+
+type userLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+// lockUser locks the MSP artifacts of a user for registration, enrollment and renewal. Requests of
+// the process wait on an in-process lock, so that only one of them polls the lock file in the user's
+// directory, which serializes replicas sharing fabric.ca.client_home. It returns the function
+// releasing the lock.
+func lockUser(ctx context.Context, userDir string) (func(), error) {
+	userLocksMu.Lock()
+	l, ok := userLocks[userDir]
+	if !ok {
+		l = &userLock{sem: make(chan struct{}, 1)}
+		userLocks[userDir] = l
+	}
+	l.refs++
+	userLocksMu.Unlock()
+
+	done := func() {
+		userLocksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(userLocks, userDir)
+		}
+		userLocksMu.Unlock()
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		done()
+		return nil, fmt.Errorf("failed to lock user directory: %w", ctx.Err())
+	}
+
+	unlockFile, err := lockFile(ctx, filepath.Join(userDir, userLockFile))
+	if err != nil {
+		<-l.sem
+		done()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile()
+		<-l.sem
+		done()
+	}, nil
+}
+
+// lockFile creates the lock file at path, waiting while another replica holds it. A lock file older
+// than userLockLease is taken over. The returned function removes the lock file, unless it was
+// taken over meanwhile.
+func lockFile(ctx context.Context, path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create user directory: %w", err)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.WriteString(token)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, fmt.Errorf("failed to write lock file: %w", err)
+			}
+			return func() { removeLockFile(path, token) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("failed to create lock file: %w", err)
+		}
+
+		info, err := os.Stat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			continue // released in the meantime
+		case err != nil:
+			return nil, fmt.Errorf("failed to check lock file: %w", err)
+		case time.Since(info.ModTime()) > userLockLease:
+			if holder, err := os.ReadFile(path); err == nil {
+				logger.Warn("Taking over abandoned lock file", zap.String("path", path))
+				removeLockFile(path, string(holder))
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to lock user directory: %w", ctx.Err())
+		case <-time.After(userLockPoll):
+		}
+	}
+}
+
+// removeLockFile removes the lock file at path if it is still held by token.
+func removeLockFile(path, token string) {
+	holder, err := os.ReadFile(path)
+	if err != nil || string(holder) != token {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Error("Failed to remove lock file", zap.String("path", path), zap.Error(err))
+	}
+}
@@ -0,0 +1,153 @@
+package fabric
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+func TestLockUserSerializes(t *testing.T) {
+	userDir := t.TempDir()
+	var holders, maxHolders atomic.Int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockUser(context.Background(), userDir)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if n := holders.Add(1); n > maxHolders.Load() {
+				maxHolders.Store(n)
+			}
+			time.Sleep(10 * time.Millisecond)
+			holders.Add(-1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxHolders.Load() != 1 {
+		t.Errorf("%d requests held the lock at once, want 1", maxHolders.Load())
+	}
+	if _, err := os.Stat(filepath.Join(userDir, userLockFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+	userLocksMu.Lock()
+	defer userLocksMu.Unlock()
+	if _, ok := userLocks[userDir]; ok {
+		t.Error("in-process lock left behind")
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     time.Duration // of the lock file of another replica
+		wantErr bool
+	}{
+		{"held by another replica", time.Second, true},
+		{"abandoned by a crashed replica", userLockLease + time.Minute, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), userLockFile)
+			if err := os.WriteFile(path, []byte("other-replica"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			modTime := time.Now().Add(-tt.age)
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*userLockPoll)
+			defer cancel()
+			unlock, err := lockFile(ctx, path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lockFile() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if holder, _ := os.ReadFile(path); string(holder) != "other-replica" {
+					t.Error("lock file of another replica was replaced")
+				}
+				return
+			}
+
+			if holder, _ := os.ReadFile(path); string(holder) == "other-replica" {
+				t.Error("abandoned lock file was not taken over")
+			}
+			unlock()
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("lock file not removed on unlock: %v", err)
+			}
+		})
+	}
+}
+
+func TestLockFileReleased(t *testing.T) {
+	path := filepath.Join(t.TempDir(), userLockFile)
+	if err := os.WriteFile(path, []byte("other-replica"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(2 * userLockPoll)
+		removeLockFile(path, "other-replica")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	unlock, err := lockFile(ctx, path)
+	if err != nil {
+		t.Fatalf("lockFile() error = %v, want the lock once released", err)
+	}
+	unlock()
+}
+
+func TestUnlockKeepsLockTakenOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), userLockFile)
+	unlock, err := lockFile(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another replica took the lock over, considering this one crashed
+	if err := os.WriteFile(path, []byte("other-replica"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	if holder, err := os.ReadFile(path); err != nil || string(holder) != "other-replica" {
+		t.Errorf("unlock removed the lock of another replica: %v", err)
+	}
+}
+
+func TestLockUserCanceled(t *testing.T) {
+	userDir := t.TempDir()
+	unlock, err := lockUser(context.Background(), userDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := lockUser(ctx, userDir); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lockUser() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
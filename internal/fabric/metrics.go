@@ -0,0 +1,116 @@
+package fabric
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	gatewayPeersDesc = prometheus.NewDesc("fabric_proxy_gateway_peers",
+		"Gateway peer connections of an organization by health state.",
+		[]string{"org", "state"}, nil)
+
+	certExpiryDesc = prometheus.NewDesc("fabric_proxy_identity_cert_expiry_timestamp_seconds",
+		"Expiry of the enrollment certificates of stored identities, as Unix time.",
+		[]string{"org", "identity"}, nil)
+)
+
+// collector exports the gateway connection pools and the certificate expiry of the identities
+// stored below the client home of every organization.
+type collector struct {
+	mu     sync.Mutex
+	expiry map[string]certExpiry // by certificate path
+}
+
+// certExpiry caches the expiry of a certificate file until it is modified.
+type certExpiry struct {
+	modTime  time.Time
+	notAfter time.Time
+}
+
+func newCollector() *collector {
+	return &collector{expiry: make(map[string]certExpiry)}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- gatewayPeersDesc
+	ch <- certExpiryDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, org := range Orgs() {
+		var healthy, unhealthy float64
+		for _, p := range org.peers.peers {
+			if p.unhealthy.Load() {
+				unhealthy++
+			} else {
+				healthy++
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(gatewayPeersDesc, prometheus.GaugeValue, healthy, org.Name, "healthy")
+		ch <- prometheus.MustNewConstMetric(gatewayPeersDesc, prometheus.GaugeValue, unhealthy, org.Name, "unhealthy")
+
+		identities := map[string]string{org.CA.Admin: signcert(org.CA.ClientHome)}
+		users, _ := filepath.Glob(filepath.Join(org.CA.ClientHome, "users", "*"))
+		for _, userDir := range users {
+			identities[filepath.Base(userDir)] = signcert(userDir)
+		}
+
+		for id, path := range identities {
+			notAfter, ok := c.notAfter(path)
+			if !ok {
+				continue
+			}
+			seen[path] = true
+			ch <- prometheus.MustNewConstMetric(certExpiryDesc, prometheus.GaugeValue, float64(notAfter.Unix()), org.Name, id)
+		}
+	}
+
+	for path := range c.expiry {
+		if !seen[path] {
+			delete(c.expiry, path)
+		}
+	}
+}
+
+// notAfter returns the expiry of the certificate at path, reading it only if it changed.
+func (c *collector) notAfter(path string) (time.Time, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if cached, ok := c.expiry[path]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.notAfter, true
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return time.Time{}, false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	c.expiry[path] = certExpiry{modTime: info.ModTime(), notAfter: cert.NotAfter}
+	return cert.NotAfter, true
+}
+
+// signcert returns the path of the enrollment certificate below a CA client home directory.
+func signcert(homeDir string) string {
+	return filepath.Join(homeDir, "msp", "signcerts", "cert.pem")
+}
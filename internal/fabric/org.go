@@ -0,0 +1,358 @@
+package fabric
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/util"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/connectivity"
+)
+
+var (
+	// ErrUnknownOrg is returned for users whose organization claim names no configured organization.
+	ErrUnknownOrg = errors.New("unknown organization")
+	// ErrOrgNotAllowed is returned for users whose organization claim names an organization their
+	// issuer does not belong to.
+	ErrOrgNotAllowed = errors.New("organization not allowed for issuer")
+)
+
+// retireDelay is how long the peer connections of a replaced organization are kept open after a
+// configuration reload, so that transactions in flight can complete.
+const retireDelay = time.Minute
+
+// orgs holds the organizations of the current configuration
+var orgs atomic.Pointer[orgSet]
+
+// orgSet is the set of organizations of one configuration, in configuration order.
+type orgSet struct {
+	byName  map[string]*Org
+	ordered []*Org
+}
+
+// Org is a member organization served by the proxy, with its own CA, MSP and gateway peers.
+type Org struct {
+	Name  string
+	CA    config.FabricCAConfig
+	GW    config.FabricGWConfig
+	peers *PeerPool
+	stop  context.CancelFunc // stops health-checking peers
+	conf  config.OrgConfig
+}
+
+// newOrg connects to the gateway peers of an organization.
+func newOrg(conf config.OrgConfig) (*Org, error) {
+	peers, err := NewPeerPool(conf.GW)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to gateway peers: %w", err)
+	}
+
+	return &Org{Name: conf.Name, CA: conf.CA, GW: conf.GW, peers: peers, conf: conf}, nil
+}
+
+// start starts health-checking the gateway peers of the organization.
+func (o *Org) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	o.stop = cancel
+	o.peers.HealthCheck(ctx, o.GW.HealthCheckInterval, o.GW.HealthCheckTimeout)
+}
+
+// close stops health-checking and closes the peer connections of the organization.
+func (o *Org) close() {
+	if o.stop != nil {
+		o.stop()
+	}
+	o.peers.Close()
+}
+
+// UserHomeDir returns the CA client home directory holding the MSP artifacts of an enrollment ID.
+func (o *Org) UserHomeDir(enrollmentID string) string {
+	return filepath.Join(o.CA.ClientHome, "users", enrollmentID)
+}
+
+// EnrollAdmin enrolls the CA admin of the organization, unless it is enrolled already.
+func (o *Org) EnrollAdmin() error {
+	adminCAClient, err := NewCAClient(o.CA)
+	if err != nil {
+		return fmt.Errorf("failed to create CA client of organization %s: %w", o.Name, err)
+	}
+
+	if _, err := adminCAClient.EnrollAdmin(); err != nil {
+		return fmt.Errorf("failed to enroll admin of organization %s: %w", o.Name, err)
+	}
+
+	return nil
+}
+
+// AdminSigner returns the enrollment certificate of the organization's admin identity and a
+// function signing digests with its private key.
+func (o *Org) AdminSigner() ([]byte, func(digest []byte) ([]byte, error), error) {
+	cert, err := os.ReadFile(signcert(o.CA.ClientHome))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read admin certificate: %w", err)
+	}
+
+	keyPath, err := GetMSPKeyfile(o.CA.ClientHome)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get admin MSP keyfile: %w", err)
+	}
+
+	sign, err := newSign(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, sign, nil
+}
+
+// CheckPeers checks the health of every gateway peer of the organization, by endpoint.
+func (o *Org) CheckPeers(ctx context.Context, timeout time.Duration) map[string]error {
+	results := make(map[string]error, len(o.peers.peers))
+	for _, p := range o.peers.peers {
+		results[p.endpoint] = p.check(ctx, timeout)
+	}
+	return results
+}
+
+// CheckChannel verifies that the organization's admin identity can query a channel, by evaluating
+// GetChainInfo of the qscc system chaincode.
+func (o *Org) CheckChannel(ctx context.Context, channelID string) error {
+	keyPath, err := GetMSPKeyfile(o.CA.ClientHome)
+	if err != nil {
+		return fmt.Errorf("failed to get admin MSP keyfile: %w", err)
+	}
+
+	adminCfg := config.Config{
+		Fabric: config.FabricConfig{
+			GW: config.FabricGWConfig{
+				MSPCert: filepath.Join(o.CA.ClientHome, "msp", "signcerts", "cert.pem"),
+				MSPKey:  keyPath,
+			},
+		},
+	}
+
+	gw, err := NewGatewayClient(ctx, o, adminCfg)
+	if err != nil {
+		return fmt.Errorf("failed to create gateway client: %w", err)
+	}
+	defer gw.Close()
+
+	if _, err := gw.GetNetwork(channelID).GetContract("qscc").EvaluateTransaction("GetChainInfo", channelID); err != nil {
+		return fmt.Errorf("failed to query channel %s: %w", channelID, err)
+	}
+
+	return nil
+}
+
+// CheckAdmin verifies that the admin identity enrolled by EnrollAdmin can be loaded from the
+// organization's client home and that its certificate has not expired.
+func (o *Org) CheckAdmin() error {
+	adminCAClient, err := NewCAClient(o.CA)
+	if err != nil {
+		return fmt.Errorf("failed to create CA client: %w", err)
+	}
+
+	if _, err := adminCAClient.caClient.LoadMyIdentity(); err != nil {
+		return fmt.Errorf("failed to load admin identity: %w", err)
+	}
+
+	notAfter, err := certNotAfter(o.CA.ClientHome)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(notAfter) {
+		return fmt.Errorf("admin certificate expired at %s", notAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// CheckCA requests the cainfo of the organization's CA and returns the CA name.
+func (o *Org) CheckCA() (string, error) {
+	caClient, err := NewCAClient(o.CA)
+	if err != nil {
+		return "", fmt.Errorf("failed to create CA client: %w", err)
+	}
+
+	info, err := caClient.CAInfo()
+	if err != nil {
+		return "", err
+	}
+
+	return info.CAName, nil
+}
+
+// GatewayStates returns the gRPC connectivity state of every gateway peer, by endpoint, and an
+// error unless at least one peer is connected or idle and passes health checks.
+func (o *Org) GatewayStates() (map[string]string, error) {
+	states := make(map[string]string, len(o.peers.peers))
+	available := false
+	for _, p := range o.peers.peers {
+		state := p.conn.GetState()
+		states[p.endpoint] = state.String()
+		if (state == connectivity.Ready || state == connectivity.Idle) && !p.unhealthy.Load() {
+			available = true
+		}
+	}
+
+	if !available {
+		return states, fmt.Errorf("no gateway peer of organization %s is available", o.Name)
+	}
+
+	return states, nil
+}
+
+// newOrgs creates the default organization and those in fabric.orgs.
+func newOrgs(conf config.FabricConfig) (*orgSet, error) {
+	set := &orgSet{byName: make(map[string]*Org)}
+	for _, orgConf := range conf.Organizations() {
+		if orgConf.Name == "" {
+			set.close()
+			return nil, fmt.Errorf("every entry of fabric.orgs needs a name")
+		}
+		if _, ok := set.byName[orgConf.Name]; ok {
+			set.close()
+			return nil, fmt.Errorf("organization %s is configured more than once", orgConf.Name)
+		}
+
+		org, err := newOrg(orgConf)
+		if err != nil {
+			set.close()
+			return nil, fmt.Errorf("organization %s: %w", orgConf.Name, err)
+		}
+		set.add(org)
+	}
+
+	return set, nil
+}
+
+func (s *orgSet) add(org *Org) {
+	s.byName[org.Name] = org
+	s.ordered = append(s.ordered, org)
+}
+
+// start starts health-checking the peers of all organizations.
+func (s *orgSet) start() {
+	for _, org := range s.ordered {
+		org.start()
+	}
+}
+
+// close closes all organizations.
+func (s *orgSet) close() {
+	for _, org := range s.ordered {
+		org.close()
+	}
+}
+
+// reloadOrgs is the config.Reloader of the organizations. Organizations keep their peer
+// connections unless their gateway settings changed; replaced connections are closed once
+// transactions in flight had time to complete.
+func reloadOrgs(_, next *config.Config) (func(), error) {
+	current := orgs.Load()
+	set := &orgSet{byName: make(map[string]*Org)}
+	var created []*Org
+	kept := make(map[*PeerPool]bool)
+
+	for _, orgConf := range next.Fabric.Organizations() {
+		if old, ok := current.byName[orgConf.Name]; ok && reflect.DeepEqual(old.GW, orgConf.GW) {
+			set.add(&Org{Name: orgConf.Name, CA: orgConf.CA, GW: orgConf.GW, peers: old.peers, stop: old.stop, conf: orgConf})
+			kept[old.peers] = true
+			continue
+		}
+
+		org, err := newOrg(orgConf)
+		if err != nil {
+			for _, o := range created {
+				o.close()
+			}
+			return nil, fmt.Errorf("organization %s: %w", orgConf.Name, err)
+		}
+		set.add(org)
+		created = append(created, org)
+	}
+
+	for _, org := range set.ordered {
+		if err := org.EnrollAdmin(); err != nil {
+			for _, o := range created {
+				o.close()
+			}
+			return nil, err
+		}
+	}
+
+	return func() {
+		for _, org := range created {
+			org.start()
+			logger.Info("Organization connected to gateway peers", zap.String("org", org.Name))
+		}
+		orgs.Store(set)
+
+		var retired []*Org
+		for _, org := range current.ordered {
+			if !kept[org.peers] {
+				retired = append(retired, org)
+			}
+		}
+		if len(retired) > 0 {
+			time.AfterFunc(retireDelay, func() {
+				for _, org := range retired {
+					org.close()
+					logger.Info("Closed gateway peer connections of replaced organization", zap.String("org", org.Name))
+				}
+			})
+		}
+	}, nil
+}
+
+// Orgs returns all organizations served by the proxy.
+func Orgs() []*Org {
+	return orgs.Load().ordered
+}
+
+// OrgFor returns the organization of a user: the one named by the fabric.org_claim claim if
+// present, otherwise the first one listing the user's issuer, otherwise the default organization.
+// The claim may only name an organization listing the user's issuer, or the one the issuer selects
+// anyway, so that an IdP cannot enroll its users with the CA of another organization.
+func OrgFor(user *oidc.IntrospectionResponse) (*Org, error) {
+	issuerOrg := orgOfIssuer(user.Issuer)
+
+	if cfg().Fabric.OrgClaim != "" {
+		if name, err := util.Jq(user.Claims, cfg().Fabric.OrgClaim); err == nil && name != nil {
+			s, ok := name.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %s must be a string", cfg().Fabric.OrgClaim)
+			}
+			org, ok := orgs.Load().byName[s]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownOrg, s)
+			}
+			if org != issuerOrg && !slices.Contains(org.conf.Issuers, user.Issuer) {
+				return nil, fmt.Errorf("%w: %s", ErrOrgNotAllowed, s)
+			}
+			return org, nil
+		}
+	}
+
+	return issuerOrg, nil
+}
+
+// orgOfIssuer returns the first organization listing an issuer, otherwise the default organization.
+func orgOfIssuer(iss string) *Org {
+	for _, org := range Orgs() {
+		if slices.Contains(org.conf.Issuers, iss) {
+			return org
+		}
+	}
+
+	return orgs.Load().byName[config.DefaultOrg]
+}
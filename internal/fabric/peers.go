@@ -0,0 +1,221 @@
+package fabric
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// Balancing strategies across gateway peers.
+const (
+	BalancingRoundRobin   = "round_robin"
+	BalancingLeastLatency = "least_latency"
+)
+
+// latencyWeight is the weight of a new sample in a peer's moving average latency
+const latencyWeight = 0.3
+
+// gatewayPeer is a gateway peer with its gRPC connection and health.
+type gatewayPeer struct {
+	endpoint  string
+	conn      *grpc.ClientConn
+	unhealthy atomic.Bool
+	latency   atomic.Int64 // moving average in nanoseconds
+}
+
+// observe records the latency of a successful call.
+func (p *gatewayPeer) observe(d time.Duration) {
+	prev := p.latency.Load()
+	if prev == 0 {
+		p.latency.Store(int64(d))
+		return
+	}
+	p.latency.Store(int64(latencyWeight*float64(d) + (1-latencyWeight)*float64(prev)))
+}
+
+// PeerPool balances gateway requests across several peers, skipping peers that fail health checks.
+// Connections are shared by all users; a user's identity only affects the gateway on top of them.
+type PeerPool struct {
+	peers     []*gatewayPeer
+	balancing string
+	next      atomic.Uint64
+}
+
+// NewPeerPool creates gRPC connections to the configured gateway peers. Connections are
+// established lazily, so unreachable peers do not fail startup.
+func NewPeerPool(conf config.FabricGWConfig) (*PeerPool, error) {
+	switch conf.Balancing {
+	case "", BalancingRoundRobin, BalancingLeastLatency:
+	default:
+		return nil, fmt.Errorf("unknown fabric.gw.balancing %q", conf.Balancing)
+	}
+
+	pool := &PeerPool{balancing: conf.Balancing}
+	for _, peerConf := range conf.GatewayPeers() {
+		conn, err := newGrpcConnection(conf, peerConf)
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("peer %s: %w", peerConf.Endpoint, err)
+		}
+		pool.peers = append(pool.peers, &gatewayPeer{endpoint: peerConf.Endpoint, conn: conn})
+	}
+
+	return pool, nil
+}
+
+// Close closes the connections to all peers.
+func (pp *PeerPool) Close() {
+	for _, p := range pp.peers {
+		p.conn.Close()
+	}
+}
+
+// pick selects a peer for the next request, skipping excluded and unhealthy peers. If no peer is
+// healthy, any peer not excluded is returned, since health may be stale.
+func (pp *PeerPool) pick(exclude map[*gatewayPeer]bool) (*gatewayPeer, error) {
+	var candidates, fallback []*gatewayPeer
+	for _, p := range pp.peers {
+		if exclude[p] {
+			continue
+		}
+		fallback = append(fallback, p)
+		if !p.unhealthy.Load() {
+			candidates = append(candidates, p)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no gateway peer available")
+	}
+
+	if pp.balancing == BalancingLeastLatency {
+		best := candidates[0]
+		for _, p := range candidates[1:] {
+			if p.latency.Load() < best.latency.Load() {
+				best = p
+			}
+		}
+		return best, nil
+	}
+
+	return candidates[pp.next.Add(1)%uint64(len(candidates))], nil
+}
+
+// HealthCheck checks every peer once at startup and then every interval, until ctx is done.
+func (pp *PeerPool) HealthCheck(ctx context.Context, interval, timeout time.Duration) {
+	pp.checkAll(ctx, timeout)
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pp.checkAll(ctx, timeout)
+			}
+		}
+	}()
+}
+
+func (pp *PeerPool) checkAll(ctx context.Context, timeout time.Duration) {
+	for _, p := range pp.peers {
+		err := p.check(ctx, timeout)
+		wasUnhealthy := p.unhealthy.Swap(err != nil)
+		switch {
+		case err != nil && !wasUnhealthy:
+			logger.Warn("Gateway peer is unhealthy", zap.String("peer", p.endpoint), zap.Error(err))
+		case err == nil && wasUnhealthy:
+			logger.Info("Gateway peer is healthy again", zap.String("peer", p.endpoint))
+		}
+	}
+}
+
+// check calls the gRPC health service of the peer. Peers not implementing it still prove that
+// they are reachable by answering Unimplemented.
+func (p *gatewayPeer) check(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := healthpb.NewHealthClient(p.conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+	case err != nil:
+		return err
+	case resp.GetStatus() != healthpb.HealthCheckResponse_SERVING:
+		return fmt.Errorf("peer reports %s", resp.GetStatus())
+	}
+
+	p.observe(time.Since(start))
+	return nil
+}
+
+// retryable reports whether a failed call may succeed on another peer.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// newGrpcConnection creates a new gRPC connection to a gateway peer.
+// It loads the peer's TLS root certificates, configures transport credentials, and creates the connection.
+func newGrpcConnection(conf config.FabricGWConfig, peer config.PeerConfig) (*grpc.ClientConn, error) {
+	certificatePEM, err := os.ReadFile(peer.TLSTrustedCerts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS certificate file: %w", err)
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(certificatePEM) {
+		return nil, fmt.Errorf("failed to parse TLS certificate: no certificates found in %s", peer.TLSTrustedCerts)
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:    certPool,
+		ServerName: peer.ServerNameOverride,
+	}
+
+	// present a client certificate to peers requiring client authentication
+	if conf.TLSCert != "" && conf.TLSKey != "" {
+		clientCert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	transportCredentials := credentials.NewTLS(tlsConfig)
+
+	connection, err := grpc.NewClient(peer.Endpoint,
+		grpc.WithTransportCredentials(transportCredentials),
+		// trace gateway calls, but not the periodic health checks
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler(otelgrpc.WithFilter(filters.Not(filters.HealthCheck())))),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
+	}
+
+	return connection, nil
+}
@@ -0,0 +1,60 @@
+package fabric
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"google.golang.org/grpc/codes"
+)
+
+type noRetryKey struct{}
+
+// WithoutRetry returns a context in which SubmitTransaction makes a single attempt, e.g. for
+// clients retrying themselves.
+func WithoutRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+// maxAttempts returns how often a transaction is submitted at most.
+func maxAttempts(ctx context.Context, conf config.RetryConfig) int {
+	if noRetry, _ := ctx.Value(noRetryKey{}).(bool); noRetry || conf.Attempts < 1 {
+		return 1
+	}
+	return conf.Attempts
+}
+
+// retryReason returns why a failed transaction may succeed when submitted again: a read conflict
+// with a concurrent transaction, or an endorsing peer that was unavailable. It returns "" if the
+// transaction must not be retried, in particular if it may have been ordered: a retry is a new
+// transaction, which would commit as well.
+func retryReason(err error) string {
+	var txErr *TxError
+	if !errors.As(err, &txErr) {
+		return ""
+	}
+
+	switch txErr.ValidationCode {
+	case "MVCC_READ_CONFLICT", "PHANTOM_READ_CONFLICT":
+		return txErr.ValidationCode
+	}
+
+	if txErr.Phase == TxPhaseEndorse && txErr.Code == codes.Unavailable {
+		return txErr.Code.String()
+	}
+
+	return ""
+}
+
+// backoff returns the delay before the given attempt, the second being the first retry.
+func backoff(conf config.RetryConfig, attempt int) time.Duration {
+	d := float64(conf.InitialBackoff) * math.Pow(conf.Multiplier, float64(attempt-2))
+	if conf.MaxBackoff > 0 && d > float64(conf.MaxBackoff) {
+		d = float64(conf.MaxBackoff)
+	}
+	d *= 1 + conf.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d)
+}
@@ -0,0 +1,112 @@
+package fabric
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc/codes"
+)
+
+func commitFailure(code peer.TxValidationCode) error {
+	return newTxError(TxPhaseSubmit, "", &client.CommitError{TransactionID: "tx1", Code: code})
+}
+
+func TestRetryReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"read conflict", commitFailure(peer.TxValidationCode_MVCC_READ_CONFLICT), "MVCC_READ_CONFLICT"},
+		{"phantom read", commitFailure(peer.TxValidationCode_PHANTOM_READ_CONFLICT), "PHANTOM_READ_CONFLICT"},
+		{"endorsement policy failure", commitFailure(peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE), ""},
+		{"wrapped read conflict", fmt.Errorf("submit: %w", commitFailure(peer.TxValidationCode_MVCC_READ_CONFLICT)), "MVCC_READ_CONFLICT"},
+		{"endorsing peer unavailable", &TxError{Phase: TxPhaseEndorse, Code: codes.Unavailable}, "Unavailable"},
+		{"endorsement rejected by chaincode", &TxError{Phase: TxPhaseEndorse, Code: codes.Aborted}, ""},
+		{"orderer unavailable", &TxError{Phase: TxPhaseSubmit, Code: codes.Unavailable}, ""},
+		{"submit timeout", &TxError{Phase: TxPhaseSubmit, Code: codes.DeadlineExceeded}, ""},
+		{"commit status unavailable", &TxError{Phase: TxPhaseCommitStatus, Code: codes.Unavailable}, ""},
+		{"not a transaction error", errors.New("failed to create gateway client"), ""},
+		{"no error", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryReason(tt.err); got != tt.want {
+				t.Errorf("retryReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUncommitted(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"endorsement failed", &TxError{Phase: TxPhaseEndorse, Code: codes.Unavailable}, true},
+		{"rejected by the orderer", &TxError{Phase: TxPhaseSubmit, Code: codes.PermissionDenied}, true},
+		{"orderer unavailable", &TxError{Phase: TxPhaseSubmit, Code: codes.Unavailable}, false},
+		{"submit timeout", &TxError{Phase: TxPhaseSubmit, Code: codes.DeadlineExceeded}, false},
+		{"invalidated", commitFailure(peer.TxValidationCode_MVCC_READ_CONFLICT), true},
+		{"commit status unknown", &TxError{Phase: TxPhaseCommitStatus, Code: codes.DeadlineExceeded}, false},
+		{"failed before endorsement", errors.New("failed to create proposal"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Uncommitted(tt.err); got != tt.want {
+				t.Errorf("Uncommitted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	conf := config.RetryConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 250 * time.Millisecond, Multiplier: 2}
+	for attempt, want := range map[int]time.Duration{
+		2: 100 * time.Millisecond,
+		3: 200 * time.Millisecond,
+		4: 250 * time.Millisecond,
+		9: 250 * time.Millisecond,
+	} {
+		if got := backoff(conf, attempt); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	conf.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := backoff(conf, 2); got < 50*time.Millisecond || got > 150*time.Millisecond {
+			t.Fatalf("backoff with jitter 0.5 = %v, want between 50ms and 150ms", got)
+		}
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		conf config.RetryConfig
+		want int
+	}{
+		{"configured", context.Background(), config.RetryConfig{Attempts: 3}, 3},
+		{"unset", context.Background(), config.RetryConfig{}, 1},
+		{"without retry", WithoutRetry(context.Background()), config.RetryConfig{Attempts: 3}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := maxAttempts(tt.ctx, tt.conf); got != tt.want {
+				t.Errorf("maxAttempts() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
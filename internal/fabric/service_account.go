@@ -0,0 +1,112 @@
+package fabric
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/hyperledger/fabric-ca/api"
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// EnsureServiceAccount makes sure the custodial identity of a service account exists and is not about
+// to expire. The identity is registered and enrolled on first use, and re-enrolled with its existing
+// key once its certificate expires within sa.RenewBefore.
+func EnsureServiceAccount(ctx context.Context, user *oidc.IntrospectionResponse, sa config.ServiceAccountConfig) error {
+	org, err := OrgFor(user)
+	if err != nil {
+		return err
+	}
+
+	enrollmentID := EnrollmentID(user)
+	userDir := org.UserHomeDir(enrollmentID)
+
+	if !Enrolled(userDir) {
+		regReq, err := ServiceAccountRegistration(enrollmentID, sa)
+		if err != nil {
+			return err
+		}
+		if err := EnrollUser(ctx, org, regReq, sa.Profile); err != nil {
+			return fmt.Errorf("failed to enroll service account %s: %w", sa.ClientID, err)
+		}
+		return nil
+	}
+
+	if sa.RenewBefore <= 0 || !expiresWithin(userDir, sa.RenewBefore) {
+		return nil
+	}
+
+	unlock, err := lockUser(ctx, userDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// another request may have renewed the certificate while this one waited for the lock
+	if !expiresWithin(userDir, sa.RenewBefore) {
+		return nil
+	}
+
+	userCAClient, err := NewCAClient(org.CA, userDir)
+	if err != nil {
+		return fmt.Errorf("failed to initialize service account CA client: %w", err)
+	}
+
+	if _, err := userCAClient.Reenroll(sa.Profile); err != nil {
+		return fmt.Errorf("failed to renew service account %s: %w", sa.ClientID, err)
+	}
+
+	return nil
+}
+
+// ServiceAccountRegistration returns the CA registration request for a service account.
+func ServiceAccountRegistration(enrollmentID string, sa config.ServiceAccountConfig) (api.RegistrationRequest, error) {
+	idType := sa.Type
+	if idType == "" {
+		idType = "client"
+	}
+
+	// service accounts sign transactions as clients, they must never be able to act as network nodes
+	if idType == "peer" || idType == "orderer" {
+		return api.RegistrationRequest{}, fmt.Errorf("service account %s: type %s is not allowed", sa.ClientID, idType)
+	}
+
+	regReq := api.RegistrationRequest{
+		Name:           enrollmentID,
+		Type:           idType,
+		Affiliation:    sa.Affiliation,
+		MaxEnrollments: sa.MaxEnrollments,
+	}
+
+	for _, attr := range sa.Attributes {
+		regReq.Attributes = append(regReq.Attributes, api.Attribute{Name: attr.Name, Value: attr.Value, ECert: attr.ECert})
+	}
+
+	return regReq, nil
+}
+
+// expiresWithin reports whether the enrollment certificate stored in homeDir expires within d. A
+// certificate that cannot be read is reported as expiring, so that it is renewed.
+func expiresWithin(homeDir string, d time.Duration) bool {
+	notAfter, err := certNotAfter(homeDir)
+	return err != nil || time.Until(notAfter) <= d
+}
+
+// certNotAfter returns the expiry of the enrollment certificate stored in homeDir.
+func certNotAfter(homeDir string) (time.Time, error) {
+	certPEM, err := os.ReadFile(filepath.Join(homeDir, "msp", "signcerts", "cert.pem"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read certificate file: %w", err)
+	}
+
+	cert, err := identity.CertificateFromPEM(certPEM)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	return cert.NotAfter, nil
+}
@@ -0,0 +1,257 @@
+// Package idempotency stores the outcome of requests by idempotency key, so that a retried request
+// gets the response of the first one instead of being executed again. Records are files in a
+// directory, so that replicas sharing the directory share them.
+package idempotency
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMismatch is returned when a key is reused for a request with a different body.
+	ErrMismatch = errors.New("idempotency key was used for a different request")
+	// ErrInProgress is returned when the request holding a key did not complete in time.
+	ErrInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// pollInterval is how often a request waiting for one holding its key checks for its outcome
+const pollInterval = 100 * time.Millisecond
+
+// States of a record.
+const (
+	statePending = "pending"
+	stateDone    = "done"
+)
+
+// Response is the stored outcome of a request.
+type Response struct {
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   []byte            `json:"body,omitempty"`
+}
+
+// record is the file stored per key.
+type record struct {
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	State       string    `json:"state"`
+	Created     time.Time `json:"created"`
+	Response    *Response `json:"response,omitempty"`
+}
+
+// Store keeps the records of one directory, e.g. of a user.
+type Store struct {
+	Dir   string
+	TTL   time.Duration // how long outcomes are kept
+	Lease time.Duration // after which a pending record is considered abandoned by a crashed request
+	Wait  time.Duration // how long Begin waits for a pending request holding the key
+}
+
+// Claim is a key held by a request, which must be completed or released.
+type Claim struct {
+	path string
+	rec  record
+}
+
+// Begin claims key for a request identified by fingerprint, e.g. a hash of its body. If the key was
+// used before, Begin returns the stored response, ErrMismatch if the fingerprints differ, or waits
+// for the request holding it, giving up with ErrInProgress after s.Wait.
+func (s Store) Begin(ctx context.Context, key, fingerprint string) (*Response, *Claim, error) {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create idempotency directory: %w", err)
+	}
+	s.sweep()
+
+	path := filepath.Join(s.Dir, hashKey(key)+".json")
+	deadline := time.Now().Add(s.Wait)
+	for {
+		rec := record{Key: key, Fingerprint: fingerprint, State: statePending, Created: time.Now().UTC()}
+		created, err := createExclusive(path, rec)
+		if err != nil {
+			return nil, nil, err
+		}
+		if created {
+			return nil, &Claim{path: path, rec: rec}, nil
+		}
+
+		existing, err := readRecord(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			continue // released in the meantime
+		case err != nil:
+			return nil, nil, err
+		case existing.State == stateDone && time.Since(existing.Created) > s.TTL:
+			if err := removeIfUnchanged(path, existing); err != nil {
+				return nil, nil, err
+			}
+			continue
+		case existing.Fingerprint != fingerprint:
+			return nil, nil, ErrMismatch
+		case existing.State == stateDone:
+			return existing.Response, nil, nil
+		case time.Since(existing.Created) > s.Lease:
+			if err := removeIfUnchanged(path, existing); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, nil, ErrInProgress
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Completed reports whether the outcome of a request with key is stored and not expired, without
+// claiming the key. Begin returns that outcome, unless the request differs.
+func (s Store) Completed(key string) bool {
+	rec, err := readRecord(filepath.Join(s.Dir, hashKey(key)+".json"))
+	return err == nil && rec.State == stateDone && time.Since(rec.Created) <= s.TTL
+}
+
+// Complete stores the response of the request holding the claim.
+func (c *Claim) Complete(resp Response) error {
+	c.rec.State = stateDone
+	c.rec.Response = &resp
+
+	tmp, err := writeTemp(filepath.Dir(c.path), c.rec)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to store idempotency record: %w", err)
+	}
+	return nil
+}
+
+// Release gives up the claim without storing a response, so that the key can be used again.
+func (c *Claim) Release() error {
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// createExclusive writes rec to path unless the file exists. The record is written to a temporary
+// file first and then linked, so that readers never see a partially written record.
+func createExclusive(path string, rec record) (bool, error) {
+	tmp, err := writeTemp(filepath.Dir(path), rec)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Link(tmp, path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to create idempotency record: %w", err)
+	}
+	return true, nil
+}
+
+// writeTemp writes rec to a new temporary file in dir and returns its path.
+func writeTemp(dir string, rec record) (string, error) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(dir, ".tmp-"+hex.EncodeToString(suffix))
+
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write idempotency record: %w", err)
+	}
+	return tmp, nil
+}
+
+func readRecord(path string) (record, error) {
+	var rec record
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return rec, fmt.Errorf("failed to parse idempotency record %s: %w", path, err)
+	}
+	return rec, nil
+}
+
+// removeIfUnchanged removes an expired record, unless another request replaced it meanwhile.
+func removeIfUnchanged(path string, rec record) error {
+	current, err := readRecord(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.State != rec.State || !current.Created.Equal(rec.Created) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove expired idempotency record: %w", err)
+	}
+	return nil
+}
+
+// swept holds when each directory was last swept
+var swept sync.Map
+
+// sweepInterval is how often a directory is swept at most
+const sweepInterval = time.Hour
+
+// sweep removes the files of records that expired long ago, at most once per sweepInterval.
+// Records are only removed when both their TTL and lease passed since they were last written.
+func (s Store) sweep() {
+	now := time.Now()
+	if last, ok := swept.Load(s.Dir); ok && now.Sub(last.(time.Time)) < sweepInterval {
+		return
+	}
+	swept.Store(s.Dir, now)
+
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+
+	maxAge := s.TTL + s.Lease
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) < maxAge {
+			continue
+		}
+		if strings.HasSuffix(e.Name(), ".json") || strings.HasPrefix(e.Name(), ".tmp-") {
+			os.Remove(filepath.Join(s.Dir, e.Name()))
+		}
+	}
+}
+
+// hashKey returns the file name of a key, so that keys need not be valid file names.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,205 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T) Store {
+	return Store{Dir: t.TempDir(), TTL: time.Hour, Lease: time.Minute, Wait: 50 * time.Millisecond}
+}
+
+// age moves the creation time of the record of key into the past.
+func age(t *testing.T, s Store, key string, d time.Duration) {
+	t.Helper()
+	path := filepath.Join(s.Dir, hashKey(key)+".json")
+	rec, err := readRecord(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Created = rec.Created.Add(-d)
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBegin(t *testing.T) {
+	ctx := context.Background()
+	stored := Response{Status: 200, Header: map[string]string{"Content-Type": "application/json"}, Body: []byte(`{"tx_id":"tx1"}`)}
+
+	tests := []struct {
+		name        string
+		setup       func(t *testing.T, s Store) // the first request with the key
+		fingerprint string
+		wantErr     error
+		wantStored  bool
+		wantClaim   bool
+	}{
+		{
+			name:      "new key",
+			setup:     func(t *testing.T, s Store) {},
+			wantClaim: true,
+		},
+		{
+			name: "completed",
+			setup: func(t *testing.T, s Store) {
+				_, claim, _ := s.Begin(ctx, "key", "fp")
+				claim.Complete(stored)
+			},
+			wantStored: true,
+		},
+		{
+			name: "completed for a different request",
+			setup: func(t *testing.T, s Store) {
+				_, claim, _ := s.Begin(ctx, "key", "fp")
+				claim.Complete(stored)
+			},
+			fingerprint: "other",
+			wantErr:     ErrMismatch,
+		},
+		{
+			name: "in progress",
+			setup: func(t *testing.T, s Store) {
+				s.Begin(ctx, "key", "fp")
+			},
+			wantErr: ErrInProgress,
+		},
+		{
+			name: "in progress for a different request",
+			setup: func(t *testing.T, s Store) {
+				s.Begin(ctx, "key", "fp")
+			},
+			fingerprint: "other",
+			wantErr:     ErrMismatch,
+		},
+		{
+			name: "released",
+			setup: func(t *testing.T, s Store) {
+				_, claim, _ := s.Begin(ctx, "key", "fp")
+				claim.Release()
+			},
+			wantClaim: true,
+		},
+		{
+			name: "abandoned after the lease",
+			setup: func(t *testing.T, s Store) {
+				s.Begin(ctx, "key", "fp")
+				age(t, s, "key", 2*time.Minute)
+			},
+			wantClaim: true,
+		},
+		{
+			name: "expired after the TTL",
+			setup: func(t *testing.T, s Store) {
+				_, claim, _ := s.Begin(ctx, "key", "fp")
+				claim.Complete(stored)
+				age(t, s, "key", 2*time.Hour)
+			},
+			fingerprint: "other",
+			wantClaim:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testStore(t)
+			tt.setup(t, s)
+
+			fingerprint := tt.fingerprint
+			if fingerprint == "" {
+				fingerprint = "fp"
+			}
+			resp, claim, err := s.Begin(ctx, "key", fingerprint)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Begin() error = %v, want %v", err, tt.wantErr)
+			}
+			if (resp != nil) != tt.wantStored {
+				t.Errorf("Begin() response = %v, want stored %v", resp, tt.wantStored)
+			}
+			if resp != nil && (resp.Status != stored.Status || string(resp.Body) != string(stored.Body) ||
+				resp.Header["Content-Type"] != stored.Header["Content-Type"]) {
+				t.Errorf("Begin() response = %+v, want %+v", resp, stored)
+			}
+			if (claim != nil) != tt.wantClaim {
+				t.Errorf("Begin() claim = %v, want claim %v", claim, tt.wantClaim)
+			}
+		})
+	}
+}
+
+func TestBeginWaitsForCompletion(t *testing.T) {
+	s := testStore(t)
+	s.Wait = 5 * time.Second
+	ctx := context.Background()
+
+	_, claim, err := s.Begin(ctx, "key", "fp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		claim.Complete(Response{Status: 201})
+	}()
+
+	resp, _, err := s.Begin(ctx, "key", "fp")
+	if err != nil {
+		t.Fatalf("Begin() error = %v", err)
+	}
+	if resp == nil || resp.Status != 201 {
+		t.Errorf("Begin() response = %+v, want the completed one", resp)
+	}
+}
+
+func TestBeginSingleClaim(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+
+	claims := make(chan *Claim, 10)
+	for i := 0; i < cap(claims); i++ {
+		go func() {
+			_, claim, _ := s.Begin(ctx, "key", "fp")
+			claims <- claim
+		}()
+	}
+
+	var n int
+	for i := 0; i < cap(claims); i++ {
+		if <-claims != nil {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d concurrent requests claimed the key, want 1", n)
+	}
+}
+
+func TestCompleted(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+
+	if s.Completed("key") {
+		t.Error("Completed() before the key was used")
+	}
+	_, claim, _ := s.Begin(ctx, "key", "fp")
+	if s.Completed("key") {
+		t.Error("Completed() while the request is in progress")
+	}
+	claim.Complete(Response{Status: 200})
+	if !s.Completed("key") {
+		t.Error("not Completed() after the request completed")
+	}
+	age(t, s, "key", 2*time.Hour)
+	if s.Completed("key") {
+		t.Error("Completed() after the TTL")
+	}
+}
@@ -0,0 +1,196 @@
+// Package metrics defines the Prometheus metrics of the proxy and serves them.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "fabric_proxy"
+
+// Transaction phases observed by ObserveTx.
+const (
+	PhaseEndorse  = "endorse"
+	PhaseSubmit   = "submit"
+	PhaseCommit   = "commit"
+	PhaseEvaluate = "evaluate"
+)
+
+// Outcomes of enrollments and CA calls.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// registry holds the metrics of the proxy and of the Go runtime
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests rejected by rate limits or quotas by route and budget.",
+	}, []string{"route", "budget"})
+
+	txDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transaction_duration_seconds",
+		Help:      "Latency of the endorse, submit, commit and evaluate phases of transactions by channel and chaincode.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"phase", "channel", "chaincode"})
+
+	txValidationCodes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transaction_validation_codes_total",
+		Help:      "Committed transactions by channel, chaincode and validation code.",
+	}, []string{"channel", "chaincode", "code"})
+
+	txRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transaction_retries_total",
+		Help:      "Submitted transactions retried by channel, chaincode and reason, i.e. validation code or gRPC status.",
+	}, []string{"channel", "chaincode", "reason"})
+
+	enrollments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "enrollments_total",
+		Help:      "User registrations and enrollments by organization and result.",
+	}, []string{"org", "result"})
+
+	caDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ca_request_duration_seconds",
+		Help:      "Latency of Fabric CA calls by CA, operation and result.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"ca", "operation", "result"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, rateLimited, txDuration, txValidationCodes, txRetries, enrollments, caDuration,
+	)
+}
+
+// Register registers a collector of further metrics. Registering the same collector twice is a no-op.
+func Register(c prometheus.Collector) error {
+	if err := registry.Register(c); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// CountRateLimited counts a request rejected by a rate limit or quota.
+func CountRateLimited(route, budget string) {
+	rateLimited.WithLabelValues(route, budget).Inc()
+}
+
+// ObserveTx records the latency of a transaction phase.
+func ObserveTx(phase, channel, chaincode string, d time.Duration) {
+	txDuration.WithLabelValues(phase, channel, chaincode).Observe(d.Seconds())
+}
+
+// CountValidationCode counts a committed transaction by its validation code, e.g. VALID or MVCC_READ_CONFLICT.
+func CountValidationCode(channel, chaincode, code string) {
+	txValidationCodes.WithLabelValues(channel, chaincode, code).Inc()
+}
+
+// CountRetry counts a retried transaction by the reason it failed, e.g. MVCC_READ_CONFLICT or Unavailable.
+func CountRetry(channel, chaincode, reason string) {
+	txRetries.WithLabelValues(channel, chaincode, reason).Inc()
+}
+
+// CountEnrollment counts a user enrollment of an organization.
+func CountEnrollment(org string, err error) {
+	enrollments.WithLabelValues(org, result(err)).Inc()
+}
+
+// ObserveCA records the latency of a call to a Fabric CA.
+func ObserveCA(ca, operation string, d time.Duration, err error) {
+	caDuration.WithLabelValues(ca, operation, result(err)).Observe(d.Seconds())
+}
+
+func result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// Middleware counts requests and observes their latency. Requests are labeled with the route
+// pattern they matched, e.g. "POST /api/v1/{channel}/{chaincode}/submit-transaction", so that path
+// parameters do not create a label value per request.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder records the status code written to a http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush supports streaming responses.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying http.ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
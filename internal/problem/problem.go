@@ -0,0 +1,90 @@
+// Package problem writes error responses as RFC 9457 problem details (application/problem+json).
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ContentType is the media type of problem details.
+const ContentType = "application/problem+json"
+
+// Problem is a problem details object. Extensions are serialized as additional members.
+type Problem struct {
+	Type       string // URI reference identifying the problem type, about:blank if empty
+	Title      string // defaults to the status text
+	Status     int
+	Detail     string
+	Instance   string
+	Extensions map[string]interface{}
+}
+
+// New returns a problem with the given status and detail.
+func New(status int, detail string) *Problem {
+	return &Problem{Status: status, Detail: detail}
+}
+
+// With sets an extension member and returns the problem.
+func (p *Problem) With(key string, value interface{}) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]interface{})
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+// MarshalJSON serializes the standard members alongside the extensions.
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+
+	m["type"] = p.Type
+	if p.Type == "" {
+		m["type"] = "about:blank"
+	}
+	m["title"] = p.Title
+	if p.Title == "" {
+		m["title"] = http.StatusText(p.Status)
+	}
+	m["status"] = p.Status
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+
+	return json.Marshal(m)
+}
+
+// Write writes the problem as response, with the request ID set by the request ID middleware
+// as extension, so that clients can report it.
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if id := RequestID(w, r); id != "" {
+		p.With("request_id", id)
+	}
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// Error writes a problem with the given status and detail. It replaces http.Error.
+func Error(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	Write(w, r, New(status, detail))
+}
+
+// RequestID returns the ID mw.RequestID assigned to the request, set on the response, or else the
+// one the client sent.
+func RequestID(w http.ResponseWriter, r *http.Request) string {
+	if id := w.Header().Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return r.Header.Get("X-Request-Id")
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/audit"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"go.uber.org/zap"
+)
+
+// openAudit opens the audit log, if configured, and checkpoints it until ctx is done. Checkpoints
+// are signed by the admin identity of the default organization. The returned function waits for
+// the final checkpoint and closes the log.
+func openAudit(ctx context.Context, conf config.AuditConfig) (func(), error) {
+	if conf.File == "" {
+		return func() {}, nil
+	}
+
+	signer := func() ([]byte, func([]byte) ([]byte, error), error) {
+		return fabric.Orgs()[0].AdminSigner()
+	}
+
+	l, err := audit.Open(conf.File, signer)
+	if err != nil {
+		return nil, err
+	}
+	audit.Use(l)
+	logger.Info("Audit log opened", zap.String("file", conf.File), zap.Duration("checkpoint_interval", conf.CheckpointInterval))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.Run(ctx, conf.CheckpointInterval, func(err error) {
+			logger.Error("Failed to checkpoint audit log", zap.Error(err))
+		})
+	}()
+
+	return func() {
+		<-done
+		audit.Use(nil)
+		if err := l.Close(); err != nil {
+			logger.Error("Failed to close audit log", zap.Error(err))
+		}
+	}, nil
+}
+
+// writeAudit records the outcome of an action in the audit log. A failure to write is logged, as
+// the action has already happened.
+func writeAudit(rec audit.Record, err error) {
+	if err := audit.Write(rec, err); err != nil {
+		logger.Error("Failed to write audit record", zap.String("action", rec.Action), zap.String("sub", rec.Subject), zap.Error(err))
+	}
+}
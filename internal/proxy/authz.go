@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/authz"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
+	"github.com/edgeflare/pgo"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"go.uber.org/zap"
+)
+
+// principalOf returns the principal of a user, with the groups read from the groups claim of the
+// user's issuer.
+func principalOf(user *oidc.IntrospectionResponse) (authz.Principal, error) {
+	groupsClaim := cfg().Authz.GroupsClaim
+	if issuer, ok := cfg().TrustedIssuer(user.Issuer); ok && issuer.Claims.Groups != "" {
+		groupsClaim = issuer.Claims.Groups
+	}
+
+	return authz.NewPrincipal(user, groupsClaim)
+}
+
+// txPath returns the API path invoking a chaincode in a mode, e.g. /api/v1/mychannel/basic/submit-transaction.
+func txPath(channel, chaincode, mode string) string {
+	return "/api/v1/" + channel + "/" + chaincode + "/" + mode + "-transaction"
+}
+
+// authorize evaluates the authorization policy and, if it allows the request, the CEL rules.
+// Every decision is logged.
+func authorize(user *oidc.IntrospectionResponse, req authz.Request) (authz.Decision, error) {
+	principal, err := principalOf(user)
+	if err != nil {
+		return authz.Decision{}, err
+	}
+
+	decision := policy.Load().Evaluate(principal, req)
+	if decision.Allowed && celEngine != nil {
+		celDecision := celEngine.Evaluate(authz.Input{
+			Principal: principal,
+			Method:    req.Method,
+			Path:      req.Path,
+			Request:   req,
+		})
+		celDecision.Trace = append(decision.Trace, celDecision.Trace...)
+		decision = celDecision
+	}
+
+	logger.Info("Authorization decision",
+		zap.String("iss", principal.Issuer),
+		zap.String("sub", principal.Subject),
+		zap.String("channel", req.Channel),
+		zap.String("chaincode", req.Chaincode),
+		zap.String("function", req.Function),
+		zap.String("mode", req.Mode),
+		zap.Bool("allowed", decision.Allowed),
+		zap.String("rule", decision.Rule),
+		zap.String("reason", decision.Reason),
+	)
+
+	return decision, nil
+}
+
+// explainAuthzHandler is a dry-run http.Handler that explains whether the caller's token would be
+// allowed to invoke the requested chaincode function, without invoking it.
+func explainAuthzHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := pgo.OIDCUser(r)
+	if !ok || user.Active == false {
+		problem.Error(w, r, "no user found", http.StatusUnauthorized)
+		return
+	}
+
+	var req authz.Request
+	if err := pgo.BindOrRespondError(r, w, &req); err != nil {
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = authz.ModeSubmit
+	}
+	// CEL rules see the request that would invoke the function, not this one
+	req.Method, req.Path = http.MethodPost, txPath(req.Channel, req.Chaincode, req.Mode)
+
+	decision, err := authorize(user, req)
+	if err != nil {
+		problem.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pgo.RespondJSON(w, http.StatusOK, decision)
+}
@@ -3,33 +3,53 @@ package proxy
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"path/filepath"
+	"strings"
 
 	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
 	"github.com/edgeflare/fabric-oidc-proxy/internal/util"
 	"github.com/edgeflare/pgo"
 	"github.com/hyperledger/fabric-ca/api"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
 )
 
 // enrollUserHandler is a http.Handler that registers and enrolls a user with the Fabric CA.
 func enrollUserHandler(w http.ResponseWriter, r *http.Request) {
 	user, ok := pgo.OIDCUser(r)
 	if !ok || user.Active == false {
-		http.Error(w, "no user found", http.StatusUnauthorized)
+		problem.Error(w, r, "no user found", http.StatusUnauthorized)
 		return
 	}
 
-	fabricClaim, err := util.Jq(user.Claims, cfg.Fabric.CA.OIDCClaimKey)
+	org, err := fabric.OrgFor(user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		problem.Error(w, r, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if sa, ok := serviceAccountOf(user); ok {
+		enrollServiceAccount(w, r, user, org, sa)
+		return
+	}
+
+	issuer, ok := cfg().TrustedIssuer(user.Issuer)
+	if !ok {
+		problem.Error(w, r, "untrusted issuer", http.StatusUnauthorized)
+		return
+	}
+
+	fabricClaim, err := util.Jq(user.Claims, fabricClaimKey(user, org))
+	if err != nil {
+		problem.Error(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Marshal the fabric claim to JSON
 	fabricClaimBytes, err := json.Marshal(fabricClaim)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		problem.Error(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -37,25 +57,33 @@ func enrollUserHandler(w http.ResponseWriter, r *http.Request) {
 	var regReq api.RegistrationRequest
 	err = json.Unmarshal(fabricClaimBytes, &regReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		problem.Error(w, r, err.Error(), http.StatusBadRequest)
 		return
 	}
-	regReq.Name = user.Subject
-
-	userDir := filepath.Join(cfg.Fabric.CA.ClientHome, "users", regReq.Name)
+	regReq.Name = fabric.EnrollmentID(user)
+	if !issuer.TrustFabricClaim {
+		restrictRegistration(&regReq)
+	}
 
-	var keyCert *fabric.MSPKeyCert
-	_, err = fabric.GetMSPKeyfile(userDir)
-	if err != nil {
-		if _, err := fabric.RegisterAndEnrollUser(regReq); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if issuer.AffiliationPrefix != "" {
+		if regReq.Affiliation == "" {
+			regReq.Affiliation = issuer.AffiliationPrefix
+		} else if !affiliationAllowed(regReq.Affiliation, issuer.AffiliationPrefix) {
+			problem.Error(w, r, fmt.Sprintf("affiliation %s is not allowed for issuer %s", regReq.Affiliation, issuer.Issuer), http.StatusForbidden)
 			return
 		}
 	}
 
-	keyCert, err = fabric.LoadMSPKeyCert(userDir)
+	userDir := org.UserHomeDir(regReq.Name)
+
+	if err := fabric.EnrollUser(r.Context(), org, regReq); err != nil {
+		respondError(w, r, err)
+		return
+	}
+
+	keyCert, err := fabric.LoadMSPKeyCert(userDir)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		problem.Error(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -64,3 +92,35 @@ func enrollUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	pgo.RespondJSON(w, http.StatusOK, keyCert)
 }
+
+// fabricClaimKey returns the claim holding the Fabric registration request of a user: that of the
+// user's issuer, defaulting to fabric.ca.oidc_claim_key of the user's organization.
+func fabricClaimKey(user *oidc.IntrospectionResponse, org *fabric.Org) string {
+	if issuer, ok := cfg().TrustedIssuer(user.Issuer); ok && issuer.Claims.Fabric != "" {
+		return issuer.Claims.Fabric
+	}
+	return org.CA.OIDCClaimKey
+}
+
+// restrictRegistration limits a registration request read from the token of an issuer whose fabric
+// claim is not trusted, e.g. a partner's IdP, to a client identity without hf.* attributes that
+// enrolls as often as the CA's default permits. Only the affiliation and other attributes are kept.
+func restrictRegistration(regReq *api.RegistrationRequest) {
+	regReq.Type = "client"
+	regReq.MaxEnrollments = 0
+	regReq.Secret = ""
+	regReq.CAName = ""
+
+	attrs := regReq.Attributes[:0]
+	for _, attr := range regReq.Attributes {
+		if !strings.HasPrefix(attr.Name, "hf.") {
+			attrs = append(attrs, attr)
+		}
+	}
+	regReq.Attributes = attrs
+}
+
+// affiliationAllowed reports whether affiliation equals prefix or is a sub-affiliation of it.
+func affiliationAllowed(affiliation, prefix string) bool {
+	return affiliation == prefix || strings.HasPrefix(affiliation, prefix+".")
+}
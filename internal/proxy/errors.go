@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
+	"github.com/hyperledger/fabric-ca/lib/caerrors"
+	"google.golang.org/grpc/codes"
+)
+
+// Problem types, relative to the API.
+const (
+	problemTypeTx = "/problems/transaction-failed"
+	problemTypeCA = "/problems/ca-request-failed"
+
+	problemTypeIdempotency = "/problems/idempotency-key"
+	problemTypeRateLimited = "/problems/rate-limited"
+)
+
+// respondError writes err as problem details. Fabric gateway and CA errors are mapped to a
+// status code and detailed with what the peers and the CA reported; other errors are internal.
+func respondError(w http.ResponseWriter, r *http.Request, err error) {
+	var (
+		txErr *fabric.TxError
+		caErr *fabric.CAError
+	)
+	switch {
+	case errors.As(err, &txErr):
+		problem.Write(w, r, txProblem(txErr))
+	case errors.As(err, &caErr):
+		p := problem.New(caErrorStatus(caErr), caErr.Error())
+		p.Type = problemTypeCA
+		p.With("operation", caErr.Op)
+		if caErr.Code != 0 {
+			p.With("ca_code", caErr.Code).With("ca_message", caErr.Message)
+		}
+		problem.Write(w, r, p)
+	case errors.Is(err, fabric.ErrUnknownOrg), errors.Is(err, fabric.ErrOrgNotAllowed):
+		problem.Error(w, r, err.Error(), http.StatusForbidden)
+	default:
+		problem.Error(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// txProblem describes a failed transaction with the failing phase, the gRPC status or validation
+// code, and the errors of the individual peers, including chaincode responses.
+func txProblem(e *fabric.TxError) *problem.Problem {
+	p := problem.New(txErrorStatus(e), e.Error())
+	p.Type = problemTypeTx
+	p.With("phase", e.Phase)
+	if e.TxID != "" {
+		p.With("tx_id", e.TxID)
+	}
+	if e.ValidationCode != "" {
+		p.With("validation_code", e.ValidationCode)
+	} else {
+		p.With("grpc_code", e.Code.String())
+	}
+	if msg := e.ChaincodeMessage(); msg != "" {
+		p.With("chaincode_message", msg)
+	}
+	if len(e.Peers) > 0 {
+		p.With("peers", e.Peers)
+	}
+	if e.Attempts > 0 {
+		p.With("attempts", e.Attempts)
+	}
+	if e.OutcomeUnknown() {
+		p.With("outcome", "unknown")
+	}
+	return p
+}
+
+// txErrorStatus maps a failed transaction to an HTTP status. Read conflicts are 409, so that
+// clients know the transaction may succeed when retried; chaincode errors are the client's.
+func txErrorStatus(e *fabric.TxError) int {
+	switch e.ValidationCode {
+	case "":
+	case "MVCC_READ_CONFLICT", "PHANTOM_READ_CONFLICT", "DUPLICATE_TXID":
+		return http.StatusConflict
+	default:
+		return http.StatusUnprocessableEntity
+	}
+
+	if e.ChaincodeMessage() != "" {
+		return http.StatusUnprocessableEntity
+	}
+
+	switch e.Code {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.PermissionDenied, codes.Unauthenticated:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// caErrorStatus maps a failed CA request to an HTTP status by the CA's error code.
+func caErrorStatus(e *fabric.CAError) int {
+	if errors.Is(e, fabric.ErrNotRecoverable) {
+		return http.StatusConflict
+	}
+
+	switch e.Code {
+	case caerrors.ErrDupIdentityReg:
+		return http.StatusConflict
+	case caerrors.ErrAuthorizationFailure, caerrors.ErrRegistrarRegAuth, caerrors.ErrRegistrarInvalidType,
+		caerrors.ErrRegistrarNotAffiliated, caerrors.ErrRegAttrAuth, caerrors.ErrInvokerMissAttr,
+		caerrors.ErrCallerNotAffiliated, caerrors.ErrEnrollDisabled, caerrors.ErrRevokedID,
+		caerrors.ErrPasswordAttempts, caerrors.ErrCertRevoked:
+		return http.StatusForbidden
+	case caerrors.ErrMissingRegAttr, caerrors.ErrBadCSR, caerrors.ErrInputValidCSR, caerrors.ErrInvalidMaxEnroll,
+		caerrors.ErrInvalidBool, caerrors.ErrCNInvalidEnroll, caerrors.ErrGettingAffiliation, caerrors.ErrBadReqBody:
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
+}
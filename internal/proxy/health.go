@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/auth"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/edgeflare/pgo"
+)
+
+// Status values of readiness checks.
+const (
+	statusOK           = "ok"
+	statusFailed       = "failed"
+	statusReady        = "ready"
+	statusNotReady     = "not_ready"
+	statusShuttingDown = "shutting_down"
+)
+
+var (
+	// shuttingDown makes /readyz fail once graceful shutdown began
+	shuttingDown atomic.Bool
+	// verifiers verifies tokens locally, nil if tokens are introspected by pgo's OIDC middleware
+	verifiers atomic.Pointer[auth.Verifiers]
+)
+
+// checkResult is the status of one dependency.
+type checkResult struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// readiness is the response of /readyz.
+type readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	pgo.RespondJSON(w, http.StatusOK, map[string]string{"status": statusOK})
+}
+
+// readyzHandler checks the dependencies of every organization, i.e. its admin identity, CA and
+// gateway peers, and the JWKS of issuers verifying tokens locally. It responds 503 if any check
+// fails or the server is shutting down.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		pgo.RespondJSON(w, http.StatusServiceUnavailable, readiness{Status: statusShuttingDown})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cfg().Health.Timeout)
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		checks = make(map[string]checkResult)
+	)
+	check := func(name string, fn func(ctx context.Context) (interface{}, error)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			details, err := runCheck(ctx, fn)
+			result := checkResult{Status: statusOK, Details: details}
+			if err != nil {
+				result.Status, result.Error = statusFailed, err.Error()
+			}
+			mu.Lock()
+			checks[name] = result
+			mu.Unlock()
+		}()
+	}
+
+	for _, org := range fabric.Orgs() {
+		org := org
+		check("fabric."+org.Name+".admin_identity", func(context.Context) (interface{}, error) {
+			return nil, org.CheckAdmin()
+		})
+		check("fabric."+org.Name+".ca", func(context.Context) (interface{}, error) {
+			caName, err := org.CheckCA()
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{"ca_name": caName}, nil
+		})
+		check("fabric."+org.Name+".gateway", func(context.Context) (interface{}, error) {
+			return org.GatewayStates()
+		})
+	}
+
+	if vs := verifiers.Load(); vs != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for issuer, result := range vs.CheckJWKS(ctx, cfg().Health.JWKSMaxAge) {
+				res := checkResult{Status: statusOK}
+				if !result.FetchedAt.IsZero() {
+					res.Details = map[string]time.Time{"fetched_at": result.FetchedAt}
+				}
+				if result.Err != nil {
+					res.Status, res.Error = statusFailed, result.Err.Error()
+				}
+				mu.Lock()
+				checks["oidc.jwks."+issuer] = res
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	status, code := statusReady, http.StatusOK
+	for _, c := range checks {
+		if c.Status != statusOK {
+			status, code = statusNotReady, http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	pgo.RespondJSON(w, code, readiness{Status: status, Checks: checks})
+}
+
+// runCheck runs a check, giving up once ctx is done. Checks against the CA cannot be cancelled, so
+// they may outlive the probe.
+func runCheck(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	type result struct {
+		details interface{}
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		details, err := fn(ctx)
+		done <- result{details, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.details, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
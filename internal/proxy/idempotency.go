@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/idempotency"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// replayedHeaders are the response headers stored with an outcome
+var replayedHeaders = []string{"Content-Type", attemptsHeader}
+
+// errNotSubmitted is the outcome of a submit request that failed before submitting a transaction
+var errNotSubmitted = errors.New("transaction not submitted")
+
+// claimIdempotencyKey claims the Idempotency-Key of a submit request for the user. If the key was
+// used before, it responds with the stored outcome, or an error if the request differs or is still
+// in flight, and returns false. Otherwise it returns a writer recording the response, and a function
+// to call with the outcome of the submission once the response is written. Outcomes are stored
+// unless the transaction certainly did not update the ledger, so that such requests can be retried.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request, user *oidc.IntrospectionResponse, channelID, chaincodeID string, req TxRequest) (http.ResponseWriter, func(error), bool) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		problem.Error(w, r, "Idempotency-Key must not be longer than 255 characters", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	org, err := fabric.OrgFor(user)
+	if err != nil {
+		respondError(w, r, err)
+		return nil, nil, false
+	}
+
+	conf := cfg().Idempotency
+	store := idempotencyStore(org, user)
+
+	stored, claim, err := store.Begin(r.Context(), key, txFingerprint(channelID, chaincodeID, req))
+	if err == nil && stored == nil && isReplay(r) {
+		// the stored outcome expired after limitRate let the request pass as a replay, so it was
+		// neither rate limited nor checked against the quota; the retry will be
+		if err := claim.Release(); err != nil {
+			logger.Error("Failed to release idempotency key", zap.Error(err))
+		}
+		err = idempotency.ErrInProgress
+	}
+	switch {
+	case errors.Is(err, idempotency.ErrMismatch):
+		p := problem.New(http.StatusUnprocessableEntity, err.Error())
+		p.Type = problemTypeIdempotency
+		problem.Write(w, r, p)
+		return nil, nil, false
+	case errors.Is(err, idempotency.ErrInProgress):
+		p := problem.New(http.StatusConflict, err.Error())
+		p.Type = problemTypeIdempotency
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(conf.Wait.Seconds()))))
+		problem.Write(w, r, p)
+		return nil, nil, false
+	case err != nil:
+		respondError(w, r, err)
+		return nil, nil, false
+	case stored != nil:
+		for name, value := range stored.Header {
+			w.Header().Set(name, value)
+		}
+		w.Header().Set(idempotentReplayedHeader, "true")
+		w.WriteHeader(stored.Status)
+		w.Write(stored.Body)
+		return nil, nil, false
+	}
+
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	finish := func(submitErr error) {
+		if submitErr != nil && fabric.Uncommitted(submitErr) {
+			if err := claim.Release(); err != nil {
+				logger.Error("Failed to release idempotency key", zap.Error(err))
+			}
+			return
+		}
+
+		resp := idempotency.Response{Status: rec.status, Header: make(map[string]string), Body: rec.body.Bytes()}
+		for _, name := range replayedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				resp.Header[name] = value
+			}
+		}
+		if err := claim.Complete(resp); err != nil {
+			logger.Error("Failed to store idempotent response", zap.Error(err))
+		}
+	}
+
+	return rec, finish, true
+}
+
+// replayKey is the context key marking a submit limitRate let pass as a replay of a stored outcome
+type replayKey struct{}
+
+// completedReplay reports whether the request repeats a submit whose outcome is stored under its
+// Idempotency-Key, so that limitRate lets it pass to get that outcome.
+func completedReplay(r *http.Request, user *oidc.IntrospectionResponse) bool {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+
+	org, err := fabric.OrgFor(user)
+	if err != nil {
+		return false
+	}
+	return idempotencyStore(org, user).Completed(key)
+}
+
+func isReplay(r *http.Request) bool {
+	replay, _ := r.Context().Value(replayKey{}).(bool)
+	return replay
+}
+
+// idempotencyStore returns the store of the user's idempotency records.
+func idempotencyStore(org *fabric.Org, user *oidc.IntrospectionResponse) idempotency.Store {
+	conf := cfg().Idempotency
+	return idempotency.Store{
+		Dir:   filepath.Join(org.UserHomeDir(fabric.EnrollmentID(user)), "idempotency"),
+		TTL:   conf.TTL,
+		Lease: conf.Lease,
+		Wait:  conf.Wait,
+	}
+}
+
+// txFingerprint identifies a transaction request, to detect keys reused for different requests.
+func txFingerprint(channelID, chaincodeID string, req TxRequest) string {
+	b, _ := json.Marshal(struct {
+		Channel   string   `json:"channel"`
+		Chaincode string   `json:"chaincode"`
+		Name      string   `json:"name"`
+		Args      []string `json:"args"`
+	}{channelID, chaincodeID, req.Name, req.Args})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// responseRecorder passes a response through while recording its status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying http.ResponseWriter.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"google.golang.org/grpc/codes"
+)
+
+var (
+	createAsset = TxRequest{Name: "CreateAsset", Args: []string{"asset1", "blue"}}
+	deleteAsset = TxRequest{Name: "DeleteAsset", Args: []string{"asset1"}}
+)
+
+// claim claims key for req and returns the response of a request that did not get the claim.
+func claim(t *testing.T, subject, key string, req TxRequest) (*httptest.ResponseRecorder, http.ResponseWriter, func(error), bool) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/mychannel/basic/submit-transaction", nil)
+	r.Header.Set(idempotencyKeyHeader, key)
+	rec, finish, ok := claimIdempotencyKey(w, r, testUser(subject), "mychannel", "basic", req)
+	return w, rec, finish, ok
+}
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	_, rec, finish, ok := claim(t, "alice", "key1", createAsset)
+	if !ok {
+		t.Fatal("first request did not claim the key")
+	}
+
+	tests := []struct {
+		name   string
+		req    TxRequest
+		status int
+	}{
+		{"same request in progress", createAsset, http.StatusConflict},
+		{"different request in progress", deleteAsset, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, _, _, ok := claim(t, "alice", "key1", tt.req)
+			if ok {
+				t.Fatal("claimed a key in use")
+			}
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+
+	rec.Header().Set("Content-Type", "application/json")
+	rec.WriteHeader(http.StatusOK)
+	rec.Write([]byte(`{"tx_id":"tx1"}`))
+	finish(nil)
+
+	t.Run("same request completed", func(t *testing.T) {
+		w, _, _, ok := claim(t, "alice", "key1", createAsset)
+		if ok {
+			t.Fatal("claimed a completed key")
+		}
+		if w.Code != http.StatusOK || w.Body.String() != `{"tx_id":"tx1"}` || w.Header().Get(idempotentReplayedHeader) != "true" {
+			t.Errorf("got %d %s, want the replayed outcome", w.Code, w.Body)
+		}
+	})
+
+	t.Run("different request completed", func(t *testing.T) {
+		w, _, _, ok := claim(t, "alice", "key1", deleteAsset)
+		if ok || w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+		}
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		if _, _, _, ok := claim(t, "bob", "key1", deleteAsset); !ok {
+			t.Error("keys of another user are shared")
+		}
+	})
+}
+
+func TestClaimIdempotencyKeyOutcome(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcome  error
+		released bool
+	}{
+		{"not submitted", errNotSubmitted, true},
+		{"endorsement failed", &fabric.TxError{Phase: fabric.TxPhaseEndorse, Code: codes.Aborted}, true},
+		{"rejected by the orderer", &fabric.TxError{Phase: fabric.TxPhaseSubmit, Code: codes.PermissionDenied}, true},
+		{"orderer timed out", &fabric.TxError{Phase: fabric.TxPhaseSubmit, Code: codes.DeadlineExceeded}, false},
+		{"commit status unknown", &fabric.TxError{Phase: fabric.TxPhaseCommitStatus, Code: codes.Unavailable}, false},
+		{"committed", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := "outcome-" + tt.name
+			_, rec, finish, ok := claim(t, "carol", key, createAsset)
+			if !ok {
+				t.Fatal("first request did not claim the key")
+			}
+			rec.WriteHeader(http.StatusBadGateway)
+			finish(tt.outcome)
+
+			_, _, _, ok = claim(t, "carol", key, createAsset)
+			if ok != tt.released {
+				t.Errorf("key claimed again: %v, want %v", ok, tt.released)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+	"go.uber.org/zap"
+)
+
+const testIssuer = "https://iam.example.com"
+
+// TestMain configures an organization whose peer is never connected to, since the tests only use
+// its client home.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "fabric-proxy-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	code, err := run(m, dir)
+	os.RemoveAll(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(code)
+}
+
+func run(m *testing.M, dir string) (int, error) {
+	tlsCert := filepath.Join(dir, "tls-ca.pem")
+	if err := writeSelfSignedCert(tlsCert); err != nil {
+		return 0, err
+	}
+
+	holder := config.NewHolder(&config.Config{
+		OIDC: config.OIDCConfig{Issuer: testIssuer},
+		Fabric: config.FabricConfig{
+			CA: config.FabricCAConfig{ClientHome: filepath.Join(dir, "fabric"), OIDCClaimKey: "fabric"},
+			GW: config.FabricGWConfig{MSPID: "Org1MSP", PeerEndpoint: "localhost:7051", TLSTrustedCerts: tlsCert},
+		},
+		Idempotency: config.IdempotencyConfig{TTL: time.Hour, Lease: time.Minute, Wait: 50 * time.Millisecond},
+	}, zap.NewNop())
+
+	if err := fabric.Init(holder, zap.NewNop()); err != nil {
+		return 0, err
+	}
+	conf, logger = holder, zap.NewNop()
+
+	return m.Run(), nil
+}
+
+// setConfig replaces the configuration for the duration of the test.
+func setConfig(t *testing.T, modify func(c *config.Config)) {
+	t.Helper()
+	prev := conf
+	next := *prev.Load()
+	modify(&next)
+	conf = config.NewHolder(&next, zap.NewNop())
+	t.Cleanup(func() { conf = prev })
+}
+
+func testUser(subject string) *oidc.IntrospectionResponse {
+	return &oidc.IntrospectionResponse{Active: true, Issuer: testIssuer, Subject: subject}
+}
+
+func writeSelfSignedCert(path string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tls-ca"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+}
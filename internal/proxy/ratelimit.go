@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/metrics"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/ratelimit"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/util"
+	"github.com/edgeflare/pgo"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// Budgets of rate-limited routes.
+const (
+	budgetEnroll   = "enroll"
+	budgetEvaluate = "evaluate"
+	budgetSubmit   = "submit"
+)
+
+// limiter holds the token buckets and quotas of all users.
+var limiter = ratelimit.New()
+
+// quotaKey is the context key of the submit quota a request is charged once authorized
+type quotaKey struct{}
+
+// submitQuota is the daily submit quota of a user.
+type submitQuota struct {
+	key   string
+	limit int
+}
+
+// limitRate is a middleware applying the rate limit of a budget, per user, OAuth2 client and
+// route. Submits are also checked against the daily quota of the user's identity type, which is
+// charged by chargeQuota once the submit is authorized. Limited requests get 429. The
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers describe the limit closest to
+// being exhausted. Submits repeating one whose outcome is stored under their Idempotency-Key are
+// not limited, so that they always get that outcome.
+func limitRate(budget string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := pgo.OIDCUser(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if budget == budgetSubmit && completedReplay(r, user) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), replayKey{}, true)))
+				return
+			}
+
+			route := r.Pattern
+			if route == "" {
+				route = r.URL.Path
+			}
+
+			now := time.Now()
+			limit, quota := rateLimitsFor(user, budget)
+
+			// the quota is checked first, so that a request it rejects takes no token
+			var status *ratelimit.Status
+			if quota > 0 {
+				sq := submitQuota{key: user.Issuer + "\x00" + user.Subject, limit: quota}
+				q := limiter.PeekQuota(sq.key, sq.limit, now)
+				if q.Allowed {
+					q.Remaining-- // once charged
+					r = r.WithContext(context.WithValue(r.Context(), quotaKey{}, sq))
+				}
+				status = &q
+			}
+			if limit.RPS > 0 && (status == nil || status.Allowed) {
+				burst := limit.Burst
+				if burst <= 0 {
+					burst = int(math.Ceil(limit.RPS))
+				}
+				key := strings.Join([]string{user.Issuer, user.Subject, user.ClientID, route}, "\x00")
+				b := limiter.Take(key, limit.RPS, burst, now)
+				if status == nil || !b.Allowed || b.Remaining < status.Remaining {
+					status = &b
+				}
+			}
+
+			if status == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			setRateLimitHeaders(w, *status)
+			if !status.Allowed {
+				metrics.CountRateLimited(route, budget)
+				respondRateLimited(w, r, *status, budget+" rate limit exceeded")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// chargeQuota charges the submit quota checked by limitRate, once the submit is authorized. If the
+// quota was used up meanwhile, it responds with 429 and returns false. Otherwise it returns a
+// function refunding the charge, for submits that certainly did not update the ledger.
+func chargeQuota(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	sq, ok := r.Context().Value(quotaKey{}).(submitQuota)
+	if !ok {
+		return func() {}, true
+	}
+
+	now := time.Now()
+	status := limiter.TakeQuota(sq.key, sq.limit, now)
+	if !status.Allowed {
+		setRateLimitHeaders(w, status)
+		metrics.CountRateLimited(r.Pattern, budgetSubmit)
+		respondRateLimited(w, r, status, "daily submit quota exceeded")
+		return nil, false
+	}
+
+	return func() { limiter.RefundQuota(sq.key, now) }, true
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, status ratelimit.Status) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(status.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(max(0, status.Remaining)))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(status.Reset)))
+}
+
+func respondRateLimited(w http.ResponseWriter, r *http.Request, status ratelimit.Status, detail string) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(status.RetryAfter)))
+	p := problem.New(http.StatusTooManyRequests, detail)
+	p.Type = problemTypeRateLimited
+	problem.Write(w, r, p)
+}
+
+// rateLimitsFor returns the rate limit of a budget and, for submits, the daily quota applying to a
+// user. The limits of service accounts take precedence over those of the user's groups, which
+// take precedence over the defaults.
+func rateLimitsFor(user *oidc.IntrospectionResponse, budget string) (config.RateLimitConfig, int) {
+	conf := cfg().RateLimits
+	limit := budgetLimit(conf.Enroll, conf.Evaluate, conf.Submit, budget)
+
+	var quota int
+	if budget == budgetSubmit && len(conf.DailySubmitQuota) > 0 {
+		quota = conf.DailySubmitQuota[identityType(user)]
+	}
+
+	if len(conf.Groups) > 0 {
+		if group, ok := rateLimitGroup(user, conf.Groups); ok {
+			limit = override(limit, budgetLimit(group.Enroll, group.Evaluate, group.Submit, budget))
+			if q, ok := group.DailySubmitQuota[identityType(user)]; ok && budget == budgetSubmit {
+				quota = q
+			}
+		}
+	}
+
+	if sa, ok := serviceAccountOf(user); ok {
+		limit = override(limit, sa.RateLimit)
+	}
+
+	return limit, quota
+}
+
+func budgetLimit(enroll, evaluate, submit config.RateLimitConfig, budget string) config.RateLimitConfig {
+	switch budget {
+	case budgetEnroll:
+		return enroll
+	case budgetSubmit:
+		return submit
+	}
+	return evaluate
+}
+
+// override returns o unless it is unset.
+func override(limit, o config.RateLimitConfig) config.RateLimitConfig {
+	if o.RPS == 0 {
+		return limit
+	}
+	return o
+}
+
+// rateLimitGroup returns the first entry of groups the user is a member of.
+func rateLimitGroup(user *oidc.IntrospectionResponse, groups []config.GroupRateLimitsConfig) (config.GroupRateLimitsConfig, bool) {
+	principal, err := principalOf(user)
+	if err != nil {
+		return config.GroupRateLimitsConfig{}, false
+	}
+
+	for _, g := range groups {
+		for _, member := range principal.Groups {
+			if g.Group == member {
+				return g, true
+			}
+		}
+	}
+	return config.GroupRateLimitsConfig{}, false
+}
+
+// identityType returns the Fabric identity type a user is registered with: that of the service
+// account, or the type in the registration claim, defaulting to client.
+func identityType(user *oidc.IntrospectionResponse) string {
+	if sa, ok := serviceAccountOf(user); ok {
+		if sa.Type != "" {
+			return sa.Type
+		}
+		return "client"
+	}
+
+	org, err := fabric.OrgFor(user)
+	if err != nil {
+		return "client"
+	}
+	claim, err := util.Jq(user.Claims, fabricClaimKey(user, org))
+	if err != nil {
+		return "client"
+	}
+	if reg, ok := claim.(map[string]interface{}); ok {
+		if t, ok := reg["type"].(string); ok && t != "" {
+			return t
+		}
+	}
+	return "client"
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
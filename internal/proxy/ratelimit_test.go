@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/pgo"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// submitHandler mimics invokeTx: it claims the Idempotency-Key, charges the quota of authorized
+// submits and responds with 200.
+func submitHandler(authorized bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+
+		user, _ := pgo.OIDCUser(r)
+		var finish func(error)
+		if r.Header.Get(idempotencyKeyHeader) != "" {
+			rec, f, ok := claimIdempotencyKey(w, r, user, "mychannel", "basic", createAsset)
+			if !ok {
+				return
+			}
+			w, finish = rec, f
+		}
+
+		if _, ok := chargeQuota(w, r); !ok {
+			if finish != nil {
+				finish(errNotSubmitted)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		if finish != nil {
+			finish(nil)
+		}
+	})
+}
+
+func submit(handler http.Handler, user *oidc.IntrospectionResponse, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/mychannel/basic/submit-transaction", nil)
+	r = r.WithContext(context.WithValue(r.Context(), pgo.OIDCUserCtxKey, user))
+	if key != "" {
+		r.Header.Set(idempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	limitRate(budgetSubmit)(handler).ServeHTTP(w, r)
+	return w
+}
+
+func withSubmitLimits(t *testing.T, limit config.RateLimitConfig, quota int) {
+	setConfig(t, func(c *config.Config) {
+		c.RateLimits = config.RateLimitsConfig{Submit: limit, DailySubmitQuota: map[string]int{"client": quota}}
+	})
+}
+
+func TestLimitRateQuota(t *testing.T) {
+	withSubmitLimits(t, config.RateLimitConfig{}, 2)
+	user := testUser("quota-user")
+
+	tests := []struct {
+		name       string
+		authorized bool
+		status     int
+	}{
+		{"denied submits are not counted", false, http.StatusForbidden},
+		{"denied submits are not counted again", false, http.StatusForbidden},
+		{"first", true, http.StatusOK},
+		{"second", true, http.StatusOK},
+		{"beyond the quota", true, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		w := submit(submitHandler(tt.authorized), user, "")
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	if w := submit(submitHandler(true), testUser("other-user"), ""); w.Code != http.StatusOK {
+		t.Errorf("quota of another user: status %d, want 200", w.Code)
+	}
+}
+
+func TestLimitRateQuotaTakesNoToken(t *testing.T) {
+	// a bucket of 2 tokens that is never refilled during the test
+	limit := config.RateLimitConfig{RPS: 0.0001, Burst: 2}
+	withSubmitLimits(t, limit, 1)
+	user := testUser("token-user")
+
+	if w := submit(submitHandler(true), user, ""); w.Code != http.StatusOK {
+		t.Fatalf("first submit: status %d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if w := submit(submitHandler(true), user, ""); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("submit beyond the quota: status %d", w.Code)
+		}
+	}
+
+	withSubmitLimits(t, limit, 2)
+	if w := submit(submitHandler(true), user, ""); w.Code != http.StatusOK {
+		t.Errorf("submit within the raised quota: status %d, want 200 since rejected submits took no token", w.Code)
+	}
+}
+
+func TestLimitRateReplay(t *testing.T) {
+	withSubmitLimits(t, config.RateLimitConfig{RPS: 0.0001, Burst: 1}, 1)
+	user := testUser("replay-user")
+
+	if w := submit(submitHandler(true), user, "key1"); w.Code != http.StatusOK {
+		t.Fatalf("first submit: status %d", w.Code)
+	}
+
+	// the bucket and the quota are used up, yet the outcome is replayed, repeatedly
+	for i := 0; i < 3; i++ {
+		w := submit(submitHandler(true), user, "key1")
+		if w.Code != http.StatusOK || w.Header().Get(idempotentReplayedHeader) != "true" {
+			t.Fatalf("replay %d: status %d, replayed %q", i+1, w.Code, w.Header().Get(idempotentReplayedHeader))
+		}
+	}
+
+	if w := submit(submitHandler(true), user, "key2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("submit with a new key: status %d, want 429", w.Code)
+	}
+}
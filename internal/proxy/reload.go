@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/auth"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/authz"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"go.uber.org/zap"
+)
+
+// reloadableMiddleware is a middleware that can be replaced while serving requests.
+type reloadableMiddleware struct {
+	current atomic.Pointer[func(http.Handler) http.Handler]
+}
+
+// Middleware wraps next with the current middleware, rewrapping it once after each replacement.
+func (m *reloadableMiddleware) Middleware(next http.Handler) http.Handler {
+	type wrapped struct {
+		middleware *func(http.Handler) http.Handler
+		handler    http.Handler
+	}
+	var cache atomic.Pointer[wrapped]
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := m.current.Load()
+		c := cache.Load()
+		if c == nil || c.middleware != current {
+			c = &wrapped{middleware: current, handler: (*current)(next)}
+			cache.Store(c)
+		}
+		c.handler.ServeHTTP(w, r)
+	})
+}
+
+// loadPolicy loads the authorization policy file, if configured.
+func loadPolicy(file string) (*authz.Policy, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	p, err := authz.LoadPolicy(file)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Authorization policy loaded", zap.String("file", file), zap.Int("rules", len(p.Rules)))
+
+	return p, nil
+}
+
+// reloader returns the config.Reloader of the server. It reloads the authorization policy and sets
+// up token verification again if the OIDC settings changed. Rate limits apply the new configuration
+// by themselves.
+func reloader(ctx context.Context, authn *reloadableMiddleware) config.Reloader {
+	return func(old, next *config.Config) (func(), error) {
+		p, err := loadPolicy(next.Authz.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var tokenAuthn func(http.Handler) http.Handler
+		var vs *auth.Verifiers
+		if !reflect.DeepEqual(old.OIDC, next.OIDC) {
+			tokenAuthn, vs, err = newAuthMiddleware(ctx, next.OIDC)
+			if err != nil {
+				return nil, fmt.Errorf("failed to set up OIDC authentication: %w", err)
+			}
+		}
+
+		return func() {
+			policy.Store(p)
+			if tokenAuthn != nil {
+				authn.current.Store(&tokenAuthn)
+				verifiers.Store(vs)
+				logger.Info("OIDC authentication reconfigured")
+			}
+		}, nil
+	}
+}
@@ -2,48 +2,159 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/edgeflare/fabric-oidc-proxy/internal/auth"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/authz"
 	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/metrics"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/tracing"
 	"github.com/edgeflare/pgo"
 	mw "github.com/edgeflare/pgo/middleware"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
-	cfg config.Config
+	conf      *config.Holder
+	logger    *zap.Logger
+	policy    atomic.Pointer[authz.Policy]
+	celEngine *authz.Engine
 )
 
-func StartServer(conf *config.Config, logger *zap.Logger) error {
-	// TODO: package scoped config
-	cfg = *conf
+// cfg returns the current configuration.
+func cfg() *config.Config {
+	return conf.Load()
+}
+
+func StartServer(holder *config.Holder, lgr *zap.Logger) error {
+	conf = holder
+	logger = lgr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := loadPolicy(cfg().Authz.PolicyFile)
+	if err != nil {
+		return err
+	}
+	policy.Store(p)
+
+	// Audit log, checkpointed until the server has stopped
+	auditCtx, stopAudit := context.WithCancel(context.Background())
+	defer stopAudit()
+	closeAudit, err := openAudit(auditCtx, cfg().Audit)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		stopAudit()
+		closeAudit()
+	}()
+
+	if cfg().Authz.CELPolicyFile != "" {
+		e, err := authz.NewEngine(cfg().Authz.CELPolicyFile, logger)
+		if err != nil {
+			return err
+		}
+		if err := e.Watch(ctx); err != nil {
+			return err
+		}
+		celEngine = e
+		logger.Info("CEL policy loaded", zap.String("file", cfg().Authz.CELPolicyFile))
+	}
 
 	// Create a new pgo Router
 	r := pgo.NewRouter()
 
 	// middleware
 	r.Use(mw.RequestID)
+	r.Use(tracing.Middleware)
+	r.Use(metrics.Middleware)
 	r.Use(mw.CORSWithOptions(nil)) // TODO: improve this
 	r.Use(mw.LoggerWithOptions(&mw.LoggerOptions{Logger: logger}))
 
-	// OIDC middleware for authentication
-	oidcConfig := mw.OIDCProviderConfig{
-		ClientID:     cfg.OIDC.ClientID,
-		ClientSecret: cfg.OIDC.ClientSecret,
-		Issuer:       cfg.OIDC.Issuer,
+	// OIDC middleware for authentication, replaced when the configuration is reloaded
+	tokenAuthn, vs, err := newAuthMiddleware(ctx, cfg().OIDC)
+	if err != nil {
+		return fmt.Errorf("failed to set up OIDC authentication: %w", err)
+	}
+	authn := &reloadableMiddleware{}
+	authn.current.Store(&tokenAuthn)
+	verifiers.Store(vs)
+	conf.OnReload(reloader(ctx, authn))
+	authnMiddleware := authn.Middleware
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg().HTTP.Port),
+		Handler: r,
+	}
+	tlsEnabled := cfg().HTTP.TLS.Cert != "" && cfg().HTTP.TLS.Key != ""
+	if tlsEnabled {
+		tlsConfig, err := newTLSConfig(ctx, cfg().HTTP.TLS)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+		if !cfg().HTTP.HTTP2 {
+			// a non-nil map keeps net/http from negotiating HTTP/2
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	} else if cfg().HTTP.H2C {
+		srv.Handler = h2c.NewHandler(r, &http2.Server{})
+	}
+
+	// Client certificate authentication, as alternative to OIDC tokens
+	if cfg().HTTP.TLS.ClientAuth.Enabled() {
+		if !tlsEnabled {
+			return fmt.Errorf("http.tls.client_auth requires http.tls.cert and http.tls.key")
+		}
+		clientCerts, err := auth.NewClientCerts(cfg().HTTP.TLS.ClientAuth)
+		if err != nil {
+			return fmt.Errorf("failed to set up client certificate authentication: %w", err)
+		}
+		clientCerts.ConfigureTLS(srv.TLSConfig)
+		authnMiddleware = clientCerts.Middleware(authnMiddleware)
+	}
+
+	// Liveness and readiness probes, without authentication
+	r.Handle("GET /healthz", http.HandlerFunc(healthzHandler))
+	r.Handle("GET /readyz", http.HandlerFunc(readyzHandler))
+
+	// Prometheus metrics, scraped without authentication
+	if cfg().Metrics.Enabled {
+		r.Handle("GET "+cfg().Metrics.Path, metrics.Handler())
 	}
 
 	// API v1 routes
 	apiv1 := r.Group("/api/v1")
-	apiv1.Use(mw.VerifyOIDCToken(oidcConfig))
 
-	apiv1.Handle("POST /account/enroll", http.HandlerFunc(enrollUserHandler))
-	apiv1.Handle("POST /{channel}/{chaincode}/submit-transaction", http.HandlerFunc(submitTxHandler))
+	// Browser login: session cookies are turned into bearer tokens before authentication
+	if cfg().OIDC.Session.RedirectURI != "" {
+		sessions, err := auth.NewSessions(ctx, cfg().OIDC)
+		if err != nil {
+			return fmt.Errorf("failed to set up browser login: %w", err)
+		}
+		r.Handle("GET /auth/login", sessions.LoginHandler())
+		r.Handle("GET /auth/callback", sessions.CallbackHandler())
+		r.Handle("POST /auth/logout", sessions.LogoutHandler())
+		apiv1.Use(sessions.Middleware)
+	}
+
+	apiv1.Use(authnMiddleware)
+
+	apiv1.Handle("POST /account/enroll", limitRate(budgetEnroll)(http.HandlerFunc(enrollUserHandler)))
+	apiv1.Handle("POST /{channel}/{chaincode}/submit-transaction", limitRate(budgetSubmit)(http.HandlerFunc(submitTxHandler)))
+	apiv1.Handle("POST /{channel}/{chaincode}/evaluate-transaction", limitRate(budgetEvaluate)(http.HandlerFunc(evaluateTxHandler)))
+	apiv1.Handle("POST /authz/explain", http.HandlerFunc(explainAuthzHandler))
 
 	// Set up signal handling
 	stop := make(chan os.Signal, 1)
@@ -51,8 +162,14 @@ func StartServer(conf *config.Config, logger *zap.Logger) error {
 
 	// Start the server
 	go func() {
-		logger.Info("Starting server", zap.Int("port", cfg.HTTP.Port))
-		if err := r.ListenAndServe(fmt.Sprintf(":%d", cfg.HTTP.Port)); err != nil && err != http.ErrServerClosed {
+		logger.Info("Starting server", zap.Int("port", cfg().HTTP.Port), zap.Bool("tls", tlsEnabled))
+		var err error
+		if tlsEnabled {
+			err = srv.ListenAndServeTLS("", "") // the certificate is served by TLSConfig.GetCertificate
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Server error", zap.Error(err))
 		}
 	}()
@@ -62,12 +179,16 @@ func StartServer(conf *config.Config, logger *zap.Logger) error {
 
 	logger.Info("Shutting down server...")
 
+	// Fail readiness first, so that load balancers stop routing requests before the listener closes
+	shuttingDown.Store(true)
+	time.Sleep(cfg().HTTP.ShutdownDelay)
+
 	// Create a deadline for the shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
 
 	// Attempt graceful shutdown
-	if err := r.Shutdown(ctx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		logger.Error("Server forced to shutdown", zap.Error(err))
 		return err
 	}
@@ -75,3 +196,28 @@ func StartServer(conf *config.Config, logger *zap.Logger) error {
 	logger.Info("Server gracefully stopped")
 	return nil
 }
+
+// newAuthMiddleware returns the token verification middleware for the configured trusted issuers
+// and verification mode, and the verifiers it uses. A single issuer verified by introspection uses
+// pgo's OIDC middleware, without verifiers.
+func newAuthMiddleware(ctx context.Context, oidcConf config.OIDCConfig) (func(http.Handler) http.Handler, *auth.Verifiers, error) {
+	switch oidcConf.Verification {
+	case "", "introspect":
+		if len(oidcConf.Issuers) == 0 {
+			return mw.VerifyOIDCToken(mw.OIDCProviderConfig{
+				ClientID:     oidcConf.ClientID,
+				ClientSecret: oidcConf.ClientSecret,
+				Issuer:       oidcConf.Issuer,
+			}), nil, nil
+		}
+	case "jwt":
+	default:
+		return nil, nil, fmt.Errorf("unknown oidc.verification mode %q", oidcConf.Verification)
+	}
+
+	vs, err := auth.NewVerifiers(ctx, oidcConf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return auth.VerifyToken(vs), vs, nil
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
+	"github.com/edgeflare/pgo"
+	"github.com/zitadel/oidc/v3/pkg/oidc"
+)
+
+// serviceAccountOf returns the service account a user authenticated as. The token's client_id, or
+// azp, must name the service account as well as its subject.
+func serviceAccountOf(user *oidc.IntrospectionResponse) (config.ServiceAccountConfig, bool) {
+	clientID := user.ClientID
+	if clientID == "" {
+		clientID, _ = user.Claims["azp"].(string)
+	}
+	return cfg().ServiceAccount(user.Issuer, user.Subject, clientID)
+}
+
+// enrollServiceAccount enrolls a service account as configured rather than from token claims.
+// The identity is custodial: only the certificate is returned, the private key stays with the proxy.
+func enrollServiceAccount(w http.ResponseWriter, r *http.Request, user *oidc.IntrospectionResponse, org *fabric.Org, sa config.ServiceAccountConfig) {
+	if err := fabric.EnsureServiceAccount(r.Context(), user, sa); err != nil {
+		respondError(w, r, err)
+		return
+	}
+
+	keyCert, err := fabric.LoadMSPKeyCert(org.UserHomeDir(fabric.EnrollmentID(user)))
+	if err != nil {
+		problem.Error(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pgo.RespondJSON(w, http.StatusOK, fabric.MSPKeyCert{
+		Cert: base64.StdEncoding.EncodeToString([]byte(keyCert.Cert)),
+	})
+}
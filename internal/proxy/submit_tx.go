@@ -2,22 +2,42 @@ package proxy
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/edgeflare/fabric-oidc-proxy/internal/audit"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/authz"
 	"github.com/edgeflare/fabric-oidc-proxy/internal/fabric"
+	"github.com/edgeflare/fabric-oidc-proxy/internal/problem"
 	"github.com/edgeflare/pgo"
 )
 
+// Headers controlling and reporting the retry of submitted transactions.
+const (
+	retryHeader    = "X-Fabric-Retry"    // "false" submits the transaction once, without retrying
+	attemptsHeader = "X-Fabric-Attempts" // number of times the transaction was submitted
+)
+
 type TxRequest struct {
 	Name string   `json:"name"`
 	Args []string `json:"args"`
 }
 
+// submitTxHandler submits a transaction, updating the ledger.
 func submitTxHandler(w http.ResponseWriter, r *http.Request) {
+	invokeTx(w, r, authz.ModeSubmit)
+}
+
+// evaluateTxHandler evaluates a transaction, querying the ledger on a single peer.
+func evaluateTxHandler(w http.ResponseWriter, r *http.Request) {
+	invokeTx(w, r, authz.ModeEvaluate)
+}
+
+// invokeTx authorizes and then submits or evaluates the requested chaincode function.
+func invokeTx(w http.ResponseWriter, r *http.Request, mode string) {
 	user, ok := pgo.OIDCUser(r)
 	if !ok || user.Active == false {
-		http.Error(w, "no user found", http.StatusUnauthorized)
+		problem.Error(w, r, "no user found", http.StatusUnauthorized)
 		return
 	}
 
@@ -28,19 +48,106 @@ func submitTxHandler(w http.ResponseWriter, r *http.Request) {
 
 	channeID, chaincodeID := r.PathValue("channel"), r.PathValue("chaincode")
 	if channeID == "" || chaincodeID == "" {
-		http.Error(w, "channel and chaincode name are required", http.StatusBadRequest)
+		problem.Error(w, r, "channel and chaincode name are required", http.StatusBadRequest)
+		return
+	}
+
+	decision, err := authorize(user, authz.Request{
+		Channel:   channeID,
+		Chaincode: chaincodeID,
+		Function:  req.Name,
+		Mode:      mode,
+		Args:      req.Args,
+		Method:    r.Method,
+		Path:      txPath(channeID, chaincodeID, mode),
+	})
+	if err != nil {
+		problem.Error(w, r, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	resultBytes, err := fabric.SubmitTransaction(r.Context(), channeID, chaincodeID, req.Name, req.Args...)
+	record := audit.Record{
+		Action:    audit.ActionSubmit,
+		Issuer:    user.Issuer,
+		Subject:   user.Subject,
+		RequestID: problem.RequestID(w, r),
+		Channel:   channeID,
+		Chaincode: chaincodeID,
+		Function:  req.Name,
+		ArgHashes: audit.HashArgs(req.Args),
+	}
+
+	if !decision.Allowed {
+		if mode == authz.ModeSubmit {
+			record.Result = audit.ResultDenied
+			record.Error = decision.Reason
+			writeAudit(record, nil)
+		}
+		problem.Error(w, r, decision.Reason, http.StatusForbidden)
+		return
+	}
+
+	// a submit repeated with the same Idempotency-Key gets the outcome of the first one
+	outcome := errNotSubmitted
+	if mode == authz.ModeSubmit && r.Header.Get(idempotencyKeyHeader) != "" {
+		recorder, finish, ok := claimIdempotencyKey(w, r, user, channeID, chaincodeID, req)
+		if !ok {
+			return
+		}
+		w = recorder
+		defer func() { finish(outcome) }()
+	}
+
+	// the daily submit quota is charged only once the submit is authorized and not a replay
+	if mode == authz.ModeSubmit {
+		refund, ok := chargeQuota(w, r)
+		if !ok {
+			return
+		}
+		defer func() {
+			if outcome != nil && fabric.Uncommitted(outcome) {
+				refund()
+			}
+		}()
+	}
+
+	// service accounts are enrolled on first use instead of calling /account/enroll
+	if sa, ok := serviceAccountOf(user); ok {
+		if err := fabric.EnsureServiceAccount(r.Context(), user, sa); err != nil {
+			respondError(w, r, err)
+			return
+		}
+	}
+
+	invoke := fabric.SubmitTransaction
+	if mode == authz.ModeEvaluate {
+		invoke = fabric.EvaluateTransaction
+	}
+
+	ctx := r.Context()
+	if retry, err := strconv.ParseBool(r.Header.Get(retryHeader)); err == nil && !retry {
+		ctx = fabric.WithoutRetry(ctx)
+	}
+
+	result, err := invoke(ctx, channeID, chaincodeID, req.Name, req.Args...)
+	outcome = err
+	if result != nil && result.Attempts > 0 {
+		w.Header().Set(attemptsHeader, strconv.Itoa(result.Attempts))
+	}
+	if mode == authz.ModeSubmit {
+		if result != nil {
+			record.TxID = result.TxID
+		}
+		writeAudit(record, err)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to submit transaction: %v", err), http.StatusInternalServerError)
+		respondError(w, r, err)
 		return
 	}
 
 	var resultJson json.RawMessage
-	if err := json.Unmarshal(resultBytes, &resultJson); err != nil {
-		pgo.RespondText(w, http.StatusOK, string(resultBytes))
+	if err := json.Unmarshal(result.Payload, &resultJson); err != nil {
+		pgo.RespondText(w, http.StatusOK, string(result.Payload))
 		return
 	}
 
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/edgeflare/fabric-oidc-proxy/internal/config"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// certReloader serves the certificate loaded from a key pair on disk, reloading it whenever the
+// files change, e.g. when cert-manager rotates a Secret.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the key pair and, if successful, replaces the served certificate.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// watch reloads the certificate whenever a file in the directories of the key pair changes, until
+// ctx is done. Directories are watched so that Secret updates (which swap a symlink) are noticed.
+func (c *certReloader) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch TLS certificate: %w", err)
+	}
+
+	for _, dir := range []string{filepath.Dir(c.certFile), filepath.Dir(c.keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to watch TLS certificate: %w", err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				// the key pair may be written one file at a time, a mismatch is retried on the next event
+				if err := c.reload(); err != nil {
+					logger.Warn("Failed to reload TLS certificate, keeping the previous one", zap.Error(err))
+					continue
+				}
+				logger.Info("TLS certificate reloaded", zap.String("cert", c.certFile))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("TLS certificate watcher error", zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// newTLSConfig returns the server TLS configuration, serving the reloadable certificate.
+func newTLSConfig(ctx context.Context, conf config.TLSConfig) (*tls.Config, error) {
+	certs, err := newCertReloader(conf.Cert, conf.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := certs.watch(ctx); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{GetCertificate: certs.GetCertificate}
+
+	switch conf.MinVersion {
+	case "", "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported http.tls.min_version %q, must be 1.2 or 1.3", conf.MinVersion)
+	}
+
+	if len(conf.CipherSuites) > 0 {
+		suites, err := cipherSuites(conf.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
+
+	return tlsConfig, nil
+}
+
+// cipherSuites resolves cipher suite names, rejecting those Go considers insecure.
+// TLS 1.3 cipher suites are not configurable and are ignored by crypto/tls.
+func cipherSuites(names []string) ([]uint16, error) {
+	byName := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,149 @@
+// Package ratelimit implements token bucket rate limits and daily quotas. State is kept in memory,
+// so every replica enforces the limits on its own.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// idleTimeout is after which an unused bucket is dropped; it is full again by then for any sane rate
+const idleTimeout = 10 * time.Minute
+
+// sweepInterval is how often unused buckets and past quotas are dropped
+const sweepInterval = time.Minute
+
+// Status is the outcome of taking a token or quota unit.
+type Status struct {
+	Allowed    bool
+	Limit      int           // burst of a bucket, or the quota
+	Remaining  int           // tokens or quota units left
+	Reset      time.Duration // until the bucket is full again, or the quota resets
+	RetryAfter time.Duration // until a request would be allowed, if it was not
+}
+
+// Limiter holds token buckets and daily quotas by key.
+type Limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	quotas    map[string]*quota
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	used    time.Time
+}
+
+type quota struct {
+	day  time.Time // start of the UTC day counted
+	used int
+}
+
+// New returns an empty Limiter.
+func New() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), quotas: make(map[string]*quota)}
+}
+
+// Take takes a token from the bucket of key, refilled with rps tokens per second and holding up to
+// burst tokens. A bucket whose rate or burst changed, e.g. by a configuration reload, is adjusted.
+func (l *Limiter) Take(key string, rps float64, burst int, now time.Time) Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+		l.buckets[key] = b
+	} else if b.limiter.Limit() != rate.Limit(rps) || b.limiter.Burst() != burst {
+		b.limiter.SetLimitAt(now, rate.Limit(rps))
+		b.limiter.SetBurstAt(now, burst)
+	}
+	b.used = now
+
+	status := Status{Allowed: true, Limit: burst}
+	if r := b.limiter.ReserveN(now, 1); !r.OK() {
+		status.Allowed, status.RetryAfter = false, time.Duration(math.MaxInt64)
+	} else if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		status.Allowed, status.RetryAfter = false, delay
+	}
+
+	tokens := b.limiter.TokensAt(now)
+	status.Remaining = int(math.Max(0, math.Floor(tokens)))
+	if rps > 0 {
+		status.Reset = time.Duration((float64(burst) - tokens) / rps * float64(time.Second))
+	}
+	return status
+}
+
+// TakeQuota counts a unit against the quota of key for the current UTC day, unless limit units
+// were counted already.
+func (l *Limiter) TakeQuota(key string, limit int, now time.Time) Status {
+	return l.quota(key, limit, now, true)
+}
+
+// PeekQuota reports whether a unit could be counted against the quota of key, without counting it.
+func (l *Limiter) PeekQuota(key string, limit int, now time.Time) Status {
+	return l.quota(key, limit, now, false)
+}
+
+// RefundQuota gives back a unit counted by TakeQuota at now, e.g. for a request that failed
+// without effect. Units counted on a previous day are not refunded.
+func (l *Limiter) RefundQuota(key string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	if q, ok := l.quotas[key]; ok && q.day.Equal(day) && q.used > 0 {
+		q.used--
+	}
+}
+
+func (l *Limiter) quota(key string, limit int, now time.Time, take bool) Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	q, ok := l.quotas[key]
+	if !ok || !q.day.Equal(day) {
+		q = &quota{day: day}
+		l.quotas[key] = q
+	}
+
+	reset := day.Add(24 * time.Hour).Sub(now)
+	status := Status{Allowed: q.used < limit, Limit: limit, Reset: reset}
+	if !status.Allowed {
+		status.RetryAfter = reset
+	} else if take {
+		q.used++
+	}
+	status.Remaining = limit - q.used
+	return status
+}
+
+// sweep drops idle buckets and quotas of past days, at most once per sweepInterval.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.used) > idleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	for key, q := range l.quotas {
+		if q.day.Before(day) {
+			delete(l.quotas, key)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func TestTake(t *testing.T) {
+	type take struct {
+		at         time.Duration // since start
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name  string
+		rps   float64
+		burst int
+		takes []take
+	}{
+		{
+			name: "burst then refill", rps: 1, burst: 2,
+			takes: []take{
+				{at: 0, allowed: true, remaining: 1},
+				{at: 0, allowed: true, remaining: 0},
+				{at: 0, allowed: false, remaining: 0, retryAfter: time.Second},
+				{at: 500 * time.Millisecond, allowed: false, remaining: 0, retryAfter: 500 * time.Millisecond},
+				{at: time.Second, allowed: true, remaining: 0},
+			},
+		},
+		{
+			name: "full after idle", rps: 10, burst: 3,
+			takes: []take{
+				{at: 0, allowed: true, remaining: 2},
+				{at: 0, allowed: true, remaining: 1},
+				{at: time.Hour, allowed: true, remaining: 2},
+			},
+		},
+		{
+			name: "rate below one per second", rps: 0.5, burst: 1,
+			takes: []take{
+				{at: 0, allowed: true, remaining: 0},
+				{at: time.Second, allowed: false, remaining: 0, retryAfter: time.Second},
+				{at: 2 * time.Second, allowed: true, remaining: 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New()
+			for i, tk := range tt.takes {
+				s := l.Take("alice", tt.rps, tt.burst, start.Add(tk.at))
+				if s.Allowed != tk.allowed || s.Remaining != tk.remaining || s.RetryAfter != tk.retryAfter || s.Limit != tt.burst {
+					t.Errorf("take %d: got %+v, want allowed %v, remaining %d, retry after %v", i+1, s, tk.allowed, tk.remaining, tk.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestTakeSeparatesKeys(t *testing.T) {
+	l := New()
+	if !l.Take("alice", 1, 1, start).Allowed {
+		t.Fatal("first take of alice denied")
+	}
+	if !l.Take("bob", 1, 1, start).Allowed {
+		t.Error("bob is limited by alice's bucket")
+	}
+}
+
+func TestTakeAdjustsChangedLimit(t *testing.T) {
+	l := New()
+	l.Take("alice", 1, 1, start)
+	if l.Take("alice", 1, 1, start).Allowed {
+		t.Fatal("take beyond burst allowed")
+	}
+	if s := l.Take("alice", 1, 5, start); s.Limit != 5 {
+		t.Errorf("limit %d after raising the burst, want 5", s.Limit)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	beforeMidnight := time.Date(2026, 3, 1, 23, 59, 58, 0, time.UTC)
+	l := New()
+
+	for i := 0; i < 2; i++ {
+		if s := l.TakeQuota("alice", 2, beforeMidnight); !s.Allowed || s.Remaining != 1-i {
+			t.Fatalf("take %d: got %+v", i+1, s)
+		}
+	}
+
+	s := l.TakeQuota("alice", 2, beforeMidnight)
+	if s.Allowed || s.Remaining != 0 || s.RetryAfter != 2*time.Second || s.Reset != 2*time.Second {
+		t.Errorf("take beyond quota: got %+v, want denied until midnight", s)
+	}
+	if s := l.PeekQuota("alice", 2, beforeMidnight); s.Allowed {
+		t.Errorf("peek beyond quota allowed")
+	}
+
+	midnight := beforeMidnight.Add(2 * time.Second)
+	if s := l.TakeQuota("alice", 2, midnight); !s.Allowed || s.Remaining != 1 || s.Reset != 24*time.Hour {
+		t.Errorf("take at UTC midnight: got %+v, want the quota reset", s)
+	}
+}
+
+func TestQuotaResetsAtUTCMidnight(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	// 08:59 in Tokyo is 23:59 UTC, so the quota resets a minute later, not at local midnight
+	local := time.Date(2026, 3, 2, 8, 59, 0, 0, tokyo)
+	l := New()
+
+	l.TakeQuota("alice", 1, local)
+	s := l.TakeQuota("alice", 1, local)
+	if s.Allowed || s.RetryAfter != time.Minute {
+		t.Errorf("got %+v, want denied for a minute", s)
+	}
+	if !l.TakeQuota("alice", 1, local.Add(time.Minute)).Allowed {
+		t.Error("quota not reset at UTC midnight")
+	}
+}
+
+func TestPeekQuota(t *testing.T) {
+	l := New()
+	for i := 0; i < 3; i++ {
+		if s := l.PeekQuota("alice", 1, start); !s.Allowed || s.Remaining != 1 {
+			t.Fatalf("peek %d: got %+v, want allowed without counting", i+1, s)
+		}
+	}
+}
+
+func TestRefundQuota(t *testing.T) {
+	l := New()
+	l.TakeQuota("alice", 1, start)
+	l.RefundQuota("alice", start)
+	if !l.TakeQuota("alice", 1, start).Allowed {
+		t.Fatal("refunded unit not available")
+	}
+
+	// a unit counted before midnight is not refunded to the next day's quota
+	l.RefundQuota("alice", start.Add(-24*time.Hour))
+	if l.TakeQuota("alice", 1, start).Allowed {
+		t.Error("refund of a previous day was counted")
+	}
+
+	// refunds never raise the quota above its limit
+	l.RefundQuota("bob", start)
+	l.RefundQuota("bob", start)
+	l.TakeQuota("bob", 1, start)
+	if l.TakeQuota("bob", 1, start).Allowed {
+		t.Error("refunds without takes raised the quota")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := New()
+	l.Take("alice", 1, 1, start)
+	l.TakeQuota("alice", 1, start)
+
+	l.Take("bob", 1, 1, start.Add(24*time.Hour))
+	if _, ok := l.buckets["alice"]; ok {
+		t.Error("idle bucket not dropped")
+	}
+	if _, ok := l.quotas["alice"]; ok {
+		t.Error("quota of a past day not dropped")
+	}
+}